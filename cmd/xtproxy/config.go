@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/azryve/xtproxy/pkg/aferomount"
+	"github.com/azryve/xtproxy/pkg/xtproxy"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is a declarative description of listeners, mounts and protocol settings
+type config struct {
+	Listen []listenConfig `yaml:"listen"`
+	Mounts []mountConfig  `yaml:"mounts"`
+	FTP    ftpConfig      `yaml:"ftp"`
+	TFTP   tftpConfig     `yaml:"tftp"`
+	HTTP   httpConfig     `yaml:"http"`
+	Cache  cacheConfig    `yaml:"cache"`
+}
+
+// listenConfig listens either an address or all addresses of an interface
+type listenConfig struct {
+	Protocol  string `yaml:"protocol"`
+	Address   string `yaml:"address"`   // <ip>:<port>, ip may be omitted to listen all
+	Interface string `yaml:"interface"` // listen all addresses of the interface
+	Port      int    `yaml:"port"`      // port for interface, protocol default if omitted
+}
+
+type mountConfig struct {
+	URL         string             `yaml:"url"`
+	Path        string             `yaml:"path"`
+	ReadWrite   bool               `yaml:"rw"`
+	Hidden      bool               `yaml:"hidden"`
+	Priority    int                `yaml:"priority"`
+	Protocols   []string           `yaml:"protocols"`
+	Cache       bool               `yaml:"cache"`
+	Decompress  bool               `yaml:"decompress"` // serve missing files decompressed from .gz/.xz/.zst copies
+	Redirect    time.Duration      `yaml:"redirect"`   // ttl of presigned urls http clients are redirected to
+	Credentials *credentialsConfig `yaml:"credentials"`
+}
+
+// credentialsConfig are per mount credentials for s3
+// either the access key or aws credentials file with optional profile
+type credentialsConfig struct {
+	AccessKey string `yaml:"access_key"`
+	Secret    string `yaml:"secret"`
+	File      string `yaml:"file"`
+	Profile   string `yaml:"profile"`
+}
+
+type ftpConfig struct {
+	PassivePorts string        `yaml:"passive_ports"` // <start>-<end>
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	Banner       string        `yaml:"banner"`
+}
+
+type tftpConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+	Retries int           `yaml:"retries"`
+}
+
+type httpConfig struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	RedirectExclude []string      `yaml:"redirect_exclude"` // networks proxied instead of redirected
+	WebDAV          bool          `yaml:"webdav"`
+}
+
+// cacheConfig overrides --cache-dir and --cache-size, applied on start only
+type cacheConfig struct {
+	Dir  string `yaml:"dir"`
+	Size string `yaml:"size"` // bytes with optional K, M, G or T suffix
+}
+
+// configError points to the line of the invalid value
+type configError struct {
+	File string
+	Line int
+	Path []string // keys and indexes leading to the value
+	Err  error
+}
+
+func (m *configError) Error() string {
+	field := strings.Builder{}
+	for _, p := range m.Path {
+		if _, err := strconv.Atoi(p); err == nil {
+			fmt.Fprintf(&field, "[%s]", p)
+			continue
+		}
+		if field.Len() > 0 {
+			field.WriteString(".")
+		}
+		field.WriteString(p)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", m.File, m.Line, field.String(), m.Err)
+}
+
+func (m *configError) Unwrap() error {
+	return m.Err
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, data)
+}
+
+func parseConfig(path string, data []byte) (*config, error) {
+	cfg := &config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		var cerr *configError
+		if errors.As(err, &cerr) {
+			cerr.File = path
+			cerr.Line = nodeLine(&root, cerr.Path...)
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate returns configError with path to the invalid value
+func (m *config) validate() error {
+	fieldErr := func(err error, path ...any) error {
+		fields := make([]string, len(path))
+		for i, p := range path {
+			fields[i] = fmt.Sprint(p)
+		}
+		return &configError{Path: fields, Err: err}
+	}
+	for i, l := range m.Listen {
+		if !slices.Contains(mountProtocols, l.Protocol) {
+			return fieldErr(fmt.Errorf("unknown protocol '%s'", l.Protocol), "listen", i, "protocol")
+		}
+		if (l.Address == "") == (l.Interface == "") {
+			return fieldErr(errors.New("expected either address or interface"), "listen", i)
+		}
+		if l.Address != "" {
+			if _, err := parseListenAddr(l.Address); err != nil {
+				return fieldErr(err, "listen", i, "address")
+			}
+		}
+		if l.Port < 0 || l.Port > 65535 {
+			return fieldErr(fmt.Errorf("invalid port %d", l.Port), "listen", i, "port")
+		}
+	}
+	if len(m.Mounts) == 0 {
+		return fieldErr(errors.New("expected at least one mount"), "mounts")
+	}
+	for i, mnt := range m.Mounts {
+		URL, err := url.Parse(mnt.URL)
+		if err != nil || URL.Scheme == "" {
+			return fieldErr(fmt.Errorf("invalid url '%s'", mnt.URL), "mounts", i, "url")
+		}
+		if mnt.Path == "" {
+			return fieldErr(errors.New("missing path"), "mounts", i)
+		}
+		for j, proto := range mnt.Protocols {
+			if !slices.Contains(mountProtocols, proto) {
+				return fieldErr(fmt.Errorf("unknown protocol '%s'", proto), "mounts", i, "protocols", j)
+			}
+		}
+		// archives in a bucket use its credentials but their files have no presigned urls
+		s3, archive := xtproxy.BaseScheme(URL.Scheme) == "s3", xtproxy.BaseScheme(URL.Scheme) != URL.Scheme
+		if mnt.Credentials != nil && !s3 {
+			return fieldErr(errors.New("credentials are supported only for s3:// and <archive>+s3:// mounts"), "mounts", i, "credentials")
+		}
+		if mnt.Redirect != 0 && (!s3 || archive) {
+			return fieldErr(errors.New("redirect is supported only for s3:// mounts, not <archive>+s3://"), "mounts", i, "redirect")
+		}
+		if mnt.Redirect < 0 {
+			return fieldErr(errors.New("redirect expects positive ttl"), "mounts", i, "redirect")
+		}
+		if mnt.Credentials != nil && mnt.Credentials.AccessKey != "" && mnt.Credentials.File != "" {
+			return fieldErr(errors.New("expected either access_key or file"), "mounts", i, "credentials")
+		}
+	}
+	if m.FTP.PassivePorts != "" {
+		if _, _, err := parsePortRange(m.FTP.PassivePorts); err != nil {
+			return fieldErr(err, "ftp", "passive_ports")
+		}
+	}
+	for i, network := range m.HTTP.RedirectExclude {
+		if _, err := parsePrefixes([]string{network}); err != nil {
+			return fieldErr(err, "http", "redirect_exclude", i)
+		}
+	}
+	if m.Cache.Size != "" {
+		if _, err := parseByteSize(m.Cache.Size); err != nil {
+			return fieldErr(err, "cache", "size")
+		}
+	}
+	return nil
+}
+
+// mounts returns mounts without fs set up
+func (m *config) mounts() []mountFs {
+	mounts := make([]mountFs, 0, len(m.Mounts))
+	for _, mnt := range m.Mounts {
+		URL, _ := url.Parse(mnt.URL)
+		if creds := mnt.Credentials; creds != nil {
+			query := URL.Query()
+			if creds.File != "" {
+				query.Set("credentials_file", creds.File)
+			}
+			if creds.Profile != "" {
+				query.Set("profile", creds.Profile)
+			}
+			URL.RawQuery = query.Encode()
+			if creds.AccessKey != "" {
+				URL.User = url.UserPassword(creds.AccessKey, creds.Secret)
+			}
+		}
+		mounts = append(mounts, mountFs{
+			URL:        URL,
+			Path:       mnt.Path,
+			Cache:      mnt.Cache,
+			Decompress: mnt.Decompress,
+			Redirect:   mnt.Redirect,
+			Options: aferomount.MountOptions{
+				ReadOnly:  !mnt.ReadWrite,
+				Hidden:    mnt.Hidden,
+				Priority:  mnt.Priority,
+				Protocols: mnt.Protocols,
+			},
+		})
+	}
+	return mounts
+}
+
+func (m *config) listeners() ([]listener, error) {
+	defaultPorts := map[string]int{
+		xtproxy.ProtocolFTP:  21,
+		xtproxy.ProtocolTFTP: 69,
+		xtproxy.ProtocolHTTP: 80,
+	}
+	listeners := make([]listener, 0, len(m.Listen))
+	for _, l := range m.Listen {
+		if l.Address != "" {
+			addr, _ := parseListenAddr(l.Address)
+			listeners = append(listeners, listener{Protocol: l.Protocol, Addr: addr})
+			continue
+		}
+		port := l.Port
+		if port == 0 {
+			port = defaultPorts[l.Protocol]
+		}
+		ifaceListeners, err := setupIfaceListeners(l.Interface, l.Protocol, port)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ifaceListeners...)
+	}
+	return listeners, nil
+}
+
+// settings returns protocol settings of config, http clients excluded from redirects
+// by --redirect-exclude are added to the ones of config and --webdav enables webdav
+func (m *config) settings() ([]xtproxy.XTProxyOpt, error) {
+	redirectExclude, err := parsePrefixes(append(m.HTTP.RedirectExclude, redirectExcludeFlag...))
+	if err != nil {
+		return nil, fmt.Errorf("redirect exclude: %w: %w", err, errUsage)
+	}
+	ftp := xtproxy.FTPSettings{
+		IdleTimeout: m.FTP.IdleTimeout,
+		Banner:      m.FTP.Banner,
+	}
+	if m.FTP.PassivePorts != "" {
+		ftp.PassivePortStart, ftp.PassivePortEnd, _ = parsePortRange(m.FTP.PassivePorts)
+	}
+	return []xtproxy.XTProxyOpt{
+		xtproxy.WithFTPSettings(ftp),
+		xtproxy.WithTFTPSettings(xtproxy.TFTPSettings{
+			Timeout: m.TFTP.Timeout,
+			Retries: m.TFTP.Retries,
+		}),
+		xtproxy.WithHTTPSettings(xtproxy.HTTPSettings{
+			ReadTimeout:     m.HTTP.ReadTimeout,
+			IdleTimeout:     m.HTTP.IdleTimeout,
+			RedirectExclude: redirectExclude,
+			WebDAV:          m.HTTP.WebDAV || webdavFlag,
+		}),
+	}, nil
+}
+
+// parsePrefixes parses networks in CIDR notation, a single address is a network of itself
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(network)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid network '%s' expected <ip>/<bits>", network)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseListenAddr parses <ip>:<port> or :<port> to listen on all addresses
+func parseListenAddr(addr string) (netip.AddrPort, error) {
+	if strings.HasPrefix(addr, ":") {
+		port, err := strconv.ParseUint(addr[1:], 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("invalid port '%s'", addr[1:])
+		}
+		return netip.AddrPortFrom(defaultAddr, uint16(port)), nil
+	}
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address '%s' expected <ip>:<port>", addr)
+	}
+	return addrPort, nil
+}
+
+func parsePortRange(ports string) (int, int, error) {
+	rawStart, rawEnd, ok := strings.Cut(ports, "-")
+	start, err1 := strconv.ParseUint(rawStart, 10, 16)
+	end, err2 := strconv.ParseUint(rawEnd, 10, 16)
+	if !ok || err1 != nil || err2 != nil || start > end {
+		return 0, 0, fmt.Errorf("invalid port range '%s' expected <start>-<end>", ports)
+	}
+	return int(start), int(end), nil
+}
+
+// nodeLine returns the line of a value in yaml document by path of keys and indexes
+// stopping at the deepest node found
+func nodeLine(node *yaml.Node, path ...string) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == p {
+					next = node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, err := strconv.Atoi(p); err == nil && idx < len(node.Content) {
+				next = node.Content[idx]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	data := `
+listen:
+  - protocol: tftp
+    address: ":6969"
+  - protocol: http
+    address: "127.0.0.1:8080"
+mounts:
+  - url: s3://s3.example.com/region-name/bucket-a
+    path: /
+    credentials:
+      access_key: access-a
+      secret: secret-a
+  - url: s3://s3.example.com/region-name/bucket-b
+    path: /b
+    rw: true
+    hidden: true
+    priority: 10
+    protocols: [tftp]
+    cache: true
+    decompress: true
+    credentials:
+      access_key: access-b
+      secret: secret-b
+  - url: s3://s3.example.com/region-name/bucket-c?path_style=true
+    path: /c
+    redirect: 10m
+    credentials:
+      file: /etc/xtproxy/account-c
+      profile: reader
+ftp:
+  passive_ports: 50000-50100
+tftp:
+  timeout: 3s
+  retries: 7
+http:
+  redirect_exclude: [10.0.0.0/8, "2001:db8::1"]
+  webdav: true
+`
+	cfg, err := parseConfig("xtproxy.yaml", []byte(data))
+	assert.NoError(t, err)
+
+	mounts := cfg.mounts()
+	assert.Len(t, mounts, 3)
+	assert.Equal(t, "access-a", mounts[0].URL.User.Username())
+	assert.Equal(t, "access-b", mounts[1].URL.User.Username())
+	assert.Nil(t, mounts[2].URL.User)
+	assert.Equal(t, "s3://s3.example.com/region-name/bucket-c?credentials_file=%2Fetc%2Fxtproxy%2Faccount-c&path_style=true&profile=reader", mounts[2].URL.String())
+	assert.True(t, mounts[0].Options.ReadOnly)
+	assert.False(t, mounts[1].Options.ReadOnly)
+	assert.True(t, mounts[1].Options.Hidden)
+	assert.Equal(t, 10, mounts[1].Options.Priority)
+	assert.Equal(t, []string{"tftp"}, mounts[1].Options.Protocols)
+	assert.False(t, mounts[0].Cache)
+	assert.True(t, mounts[1].Cache)
+	assert.False(t, mounts[0].Decompress)
+	assert.True(t, mounts[1].Decompress)
+	assert.Equal(t, time.Duration(0), mounts[1].Redirect)
+	assert.Equal(t, 10*time.Minute, mounts[2].Redirect)
+	assert.True(t, cfg.HTTP.WebDAV)
+	prefixes, err := parsePrefixes(cfg.HTTP.RedirectExclude)
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::1/128")}, prefixes)
+
+	listeners, err := cfg.listeners()
+	assert.NoError(t, err)
+	expected := []listener{
+		{Protocol: "tftp", Addr: netip.AddrPortFrom(defaultAddr, 6969)},
+		{Protocol: "http", Addr: netip.MustParseAddrPort("127.0.0.1:8080")},
+	}
+	assert.Equal(t, expected, listeners)
+	assert.Equal(t, 3*time.Second, cfg.TFTP.Timeout)
+	assert.Equal(t, 7, cfg.TFTP.Retries)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{
+			name: "unknown field",
+			data: `
+mounts:
+  - url: file:///srv
+    path: /
+    readonly: true
+`,
+			expected: "xtproxy.yaml: yaml: unmarshal errors:\n  line 5: field readonly not found in type main.mountConfig",
+		},
+		{
+			name: "invalid protocol",
+			data: `
+mounts:
+  - url: file:///srv
+    path: /
+  - url: file:///legacy
+    path: /legacy
+    protocols:
+      - tftp
+      - gopher
+`,
+			expected: "xtproxy.yaml:9: mounts[1].protocols[1]: unknown protocol 'gopher'",
+		},
+		{
+			name: "missing path",
+			data: `
+mounts:
+  - url: file:///srv
+`,
+			expected: "xtproxy.yaml:3: mounts[0]: missing path",
+		},
+		{
+			name: "listener address",
+			data: `
+listen:
+  - protocol: ftp
+    address: localhost
+mounts:
+  - url: file:///srv
+    path: /
+`,
+			expected: "xtproxy.yaml:4: listen[0].address: invalid address 'localhost' expected <ip>:<port>",
+		},
+		{
+			name: "credentials",
+			data: `
+mounts:
+  - url: file:///srv
+    path: /
+    credentials:
+      access_key: access
+`,
+			expected: "xtproxy.yaml:6: mounts[0].credentials: credentials are supported only for s3:// and <archive>+s3:// mounts",
+		},
+		{
+			name: "credentials file",
+			data: `
+mounts:
+  - url: s3://s3.example.com/region-name/bucket
+    path: /
+    credentials:
+      access_key: access
+      file: /etc/xtproxy/credentials
+`,
+			expected: "xtproxy.yaml:6: mounts[0].credentials: expected either access_key or file",
+		},
+		{
+			name: "redirect",
+			data: `
+mounts:
+  - url: file:///srv
+    path: /
+    redirect: 5m
+`,
+			expected: "xtproxy.yaml:5: mounts[0].redirect: redirect is supported only for s3:// mounts, not <archive>+s3://",
+		},
+		{
+			name: "redirect archive",
+			data: `
+mounts:
+  - url: tar+s3://s3.example.com/region-name/bucket/images.tar
+    path: /
+    credentials:
+      access_key: access
+    redirect: 5m
+`,
+			expected: "xtproxy.yaml:7: mounts[0].redirect: redirect is supported only for s3:// mounts, not <archive>+s3://",
+		},
+		{
+			name: "redirect ttl",
+			data: `
+mounts:
+  - url: s3://s3.example.com/region-name/bucket
+    path: /
+    redirect: -5m
+`,
+			expected: "xtproxy.yaml:5: mounts[0].redirect: redirect expects positive ttl",
+		},
+		{
+			name: "redirect exclude",
+			data: `
+mounts:
+  - url: file:///srv
+    path: /
+http:
+  redirect_exclude:
+    - 10.0.0.0/33
+`,
+			expected: "xtproxy.yaml:7: http.redirect_exclude[0]: invalid network '10.0.0.0/33' expected <ip>/<bits>",
+		},
+		{
+			name: "cache size",
+			data: `
+mounts:
+  - url: file:///srv
+    path: /
+cache:
+  dir: /var/cache/xtproxy
+  size: 10Q
+`,
+			expected: "xtproxy.yaml:7: cache.size: invalid size '10Q'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig("xtproxy.yaml", []byte(tt.data))
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
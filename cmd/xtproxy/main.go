@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -8,8 +9,15 @@ import (
 	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/azryve/xtproxy/pkg/aferocache"
+	"github.com/azryve/xtproxy/pkg/aferodecompress"
 	"github.com/azryve/xtproxy/pkg/aferomount"
 	"github.com/azryve/xtproxy/pkg/xtproxy"
 
@@ -18,7 +26,15 @@ import (
 )
 
 var debugFlag bool
+var configFlag string
+var watchConfigFlag bool
+var shutdownTimeoutFlag = 30 * time.Second
+var cacheDirFlag string
+var cacheSizeFlag = "10G"
 var writableFlag bool
+var redirectExcludeFlag []string
+var webdavFlag bool
+var defaultRedirectTTL = 5 * time.Minute
 var ifacesListen []string
 var ftpPort = 21
 var tftpPort = 69
@@ -27,14 +43,21 @@ var defaultAddr = netip.MustParseAddr("::")
 var errUsage = errors.New("error usage")
 
 type mountFs struct {
-	URL  *url.URL
-	Path string
-	Fs   afero.Fs
+	URL        *url.URL
+	Path       string
+	Fs         afero.Fs
+	Options    aferomount.MountOptions
+	Cache      bool          // read through the local cache
+	Decompress bool          // serve missing files decompressed from .gz/.xz/.zst copies
+	Redirect   time.Duration // redirect http clients to presigned urls valid for this long
 }
 
+var mountProtocols = []string{xtproxy.ProtocolFTP, xtproxy.ProtocolTFTP, xtproxy.ProtocolHTTP}
+
 var rootCmd = &cobra.Command{
 	Use:   "xtproxy",
 	Short: "xtproxy serves files with ftp/tftp",
+	Args:  cobra.ArbitraryArgs, // mounts, not subcommands
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return mainServe(args)
 	},
@@ -42,76 +65,235 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&debugFlag, "debug", false, "enable debuging")
+	rootCmd.PersistentFlags().StringVarP(&configFlag, "config", "c", "", "yaml config file with listeners, mounts and protocol settings")
+	rootCmd.Flags().BoolVar(&watchConfigFlag, "watch-config", false, "reload config file on change, SIGHUP always reloads")
+	rootCmd.Flags().DurationVar(&shutdownTimeoutFlag, "shutdown-timeout", shutdownTimeoutFlag, "wait for active transfers on SIGINT/SIGTERM before cancelling them")
+	rootCmd.PersistentFlags().StringVar(&cacheDirFlag, "cache-dir", "", "local dir to cache files of mounts with cache option")
+	rootCmd.PersistentFlags().StringVar(&cacheSizeFlag, "cache-size", cacheSizeFlag, "cache size limit, least recently used files are evicted")
 	rootCmd.Flags().StringArrayVarP(&ifacesListen, "ifaces-listen", "i", []string{}, "listen all addreses on specific ifaces")
 	rootCmd.Flags().IntVar(&ftpPort, "port-ftp", ftpPort, "ftp tcp port")
 	rootCmd.Flags().IntVar(&tftpPort, "port-tftp", tftpPort, "tftp udp port")
 	rootCmd.Flags().IntVar(&httpPort, "port-http", httpPort, "http tcp port")
-	// disabled until testing
-	// rootCmd.Flags().BoolVar(&writableFlag, "writable", false, "allow uploading")
+	rootCmd.Flags().BoolVar(&writableFlag, "writable", false, "allow uploading to mounts without ro option")
+	rootCmd.Flags().StringArrayVar(&redirectExcludeFlag, "redirect-exclude", []string{}, "proxy http clients of the network instead of redirecting them")
+	rootCmd.Flags().BoolVar(&webdavFlag, "webdav", false, "serve webdav over http, writable mounts accept changes")
 }
 
-func setupMountFs(args []string) ([]mountFs, error) {
+// parseMountArgs parses mounts from "<url> <path> [options]" args
+func parseMountArgs(args []string) ([]mountFs, error) {
 	mounts := make([]mountFs, 0, len(args))
 	for _, arg := range args {
-		urlAndPath := strings.SplitN(arg, " ", 2)
-		if len(urlAndPath) != 2 {
-			return nil, fmt.Errorf("invalid arg expected <url> <path> got '%s': %w", arg, errUsage)
+		urlAndPath := strings.SplitN(arg, " ", 3)
+		if len(urlAndPath) < 2 {
+			return nil, fmt.Errorf("invalid arg expected <url> <path> [options] got '%s': %w", arg, errUsage)
+		}
+		rawOpts := ""
+		if len(urlAndPath) == 3 {
+			rawOpts = urlAndPath[2]
 		}
 		URL, err := url.Parse(urlAndPath[0])
 		if err != nil {
 			return nil, fmt.Errorf("invalid url '%s': %w: %w", urlAndPath[0], err, errUsage)
 		}
-		if URL.Scheme == "s3" {
-			s3creds, ok := os.LookupEnv("XTPROXY_S3_CREDENTIALS")
-			if !ok {
-				return nil, errors.New("missing XTPROXY_S3_CREDENTIALS=<access_key>:<secret>")
-			}
-			userPass := strings.SplitN(s3creds, ":", 2)
-			if len(userPass) != 2 {
-				return nil, errors.New("invalid XTPROXY_S3_CREDENTIALS=<access_key>:<secret>")
-			}
-			URL.User = url.UserPassword(userPass[0], userPass[1])
+		mnt := mountFs{URL: URL, Path: urlAndPath[1]}
+		if err := parseMountOptions(rawOpts, &mnt); err != nil {
+			return nil, fmt.Errorf("invalid mount options '%s': %w: %w", rawOpts, err, errUsage)
+		}
+		mounts = append(mounts, mnt)
+	}
+	return mounts, nil
+}
+
+// setupMountFs creates fs for every mount by its url
+func setupMountFs(mounts []mountFs, cache *aferocache.Cache) error {
+	for i, m := range mounts {
+		// credentials from env stay out of the url the mount is keyed by
+		URL := &url.URL{}
+		*URL = *m.URL
+		if err := s3EnvCredentials(URL); err != nil {
+			return err
 		}
 		fs, err := xtproxy.FsByURL(URL.String())
 		if err != nil {
-			return nil, fmt.Errorf("invalid fs url '%s': %w: %w", urlAndPath[0], err, errUsage)
+			return fmt.Errorf("invalid fs url '%s': %w: %w", masked(URL), err, errUsage)
+		}
+		presigner, _ := fs.(xtproxy.Presigner)
+		if m.Decompress {
+			fs = aferodecompress.NewDecompressFs(fs)
 		}
 		if debugFlag {
 			fs = &xtproxy.DebugFs{Fs: fs}
 		}
-		mounts = append(mounts, mountFs{
-			URL:  URL,
-			Fs:   fs,
-			Path: urlAndPath[1],
-		})
+		if m.Cache {
+			if cache == nil {
+				return fmt.Errorf("mount '%s' with cache option requires --cache-dir: %w", masked(URL), errUsage)
+			}
+			fs = aferocache.NewCacheFs(fs, cache, masked(URL).String())
+		}
+		if m.Redirect > 0 {
+			if presigner == nil {
+				return fmt.Errorf("mount '%s': redirect is supported only for s3:// mounts, not <archive>+s3://: %w", masked(URL), errUsage)
+			}
+			fs = &xtproxy.RedirectFs{Fs: fs, Presigner: presigner, TTL: m.Redirect}
+		}
+		mounts[i].Fs = fs
+		mounts[i].Options.Description = masked(URL).String()
 	}
-	return mounts, nil
+	return nil
 }
 
-func setupListenAddrs() ([]netip.AddrPort, error) {
-	listenaddrs := make([]netip.AddrPort, 0)
-	if len(ifacesListen) == 0 {
-		listenaddrs = append(listenaddrs, netip.AddrPortFrom(defaultAddr, uint16(ftpPort)))
-		listenaddrs = append(listenaddrs, netip.AddrPortFrom(defaultAddr, uint16(tftpPort)))
-		listenaddrs = append(listenaddrs, netip.AddrPortFrom(defaultAddr, uint16(httpPort)))
+// s3EnvCredentials sets credentials of XTPROXY_S3_CREDENTIALS to s3 url without ones,
+// once not set the default aws credential chain is used
+func s3EnvCredentials(URL *url.URL) error {
+	query := URL.Query()
+	if xtproxy.BaseScheme(URL.Scheme) != "s3" || URL.User != nil || query.Has("profile") || query.Has("credentials_file") {
+		return nil
 	}
-	for _, ifaceName := range ifacesListen {
-		iface, err := net.InterfaceByName(ifaceName)
-		if err != nil {
-			return nil, err
+	s3creds, ok := os.LookupEnv("XTPROXY_S3_CREDENTIALS")
+	if !ok {
+		return nil
+	}
+	userPass := strings.SplitN(s3creds, ":", 2)
+	if len(userPass) != 2 {
+		return errors.New("invalid XTPROXY_S3_CREDENTIALS=<access_key>:<secret>")
+	}
+	URL.User = url.UserPassword(userPass[0], userPass[1])
+	return nil
+}
+
+// parseMountOptions parses comma separated mount options into mnt
+// ro,rw,hidden,cache,decompress,redirect[=<ttl>],priority=<int>,protocols=<proto>+<proto>
+func parseMountOptions(raw string, mnt *mountFs) error {
+	opts := &mnt.Options
+	opts.ReadOnly = !writableFlag
+	for _, opt := range strings.Split(raw, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "":
+		case "ro":
+			opts.ReadOnly = true
+		case "rw":
+			opts.ReadOnly = false
+		case "hidden":
+			opts.Hidden = true
+		case "cache":
+			mnt.Cache = true
+		case "decompress":
+			mnt.Decompress = true
+		case "redirect":
+			mnt.Redirect = defaultRedirectTTL
+			if value != "" {
+				ttl, err := time.ParseDuration(value)
+				if err != nil || ttl <= 0 {
+					return fmt.Errorf("invalid redirect ttl '%s'", value)
+				}
+				mnt.Redirect = ttl
+			}
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid priority '%s'", value)
+			}
+			opts.Priority = priority
+		case "protocols":
+			opts.Protocols = strings.Split(value, "+")
+			for _, proto := range opts.Protocols {
+				if !slices.Contains(mountProtocols, proto) {
+					return fmt.Errorf("unknown protocol '%s'", proto)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown option '%s'", key)
 		}
-		addrs, err := iface.Addrs()
-		if err != nil {
-			return nil, err
+	}
+	return nil
+}
+
+// parseByteSize parses size in bytes with optional K, M, G or T suffix
+func parseByteSize(raw string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	unit := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(raw), "B")
+	if len(num) > 0 {
+		if u, ok := units[num[len(num)-1:]]; ok {
+			unit = u
+			num = num[:len(num)-1]
+		}
+	}
+	size, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size '%s'", raw)
+	}
+	return size * unit, nil
+}
+
+// listener is a frontend protocol served on address
+type listener struct {
+	Protocol string
+	Addr     netip.AddrPort
+}
+
+func (m listener) String() string {
+	return fmt.Sprintf("%s://%s", m.Protocol, m.Addr)
+}
+
+func setupListenAddrs() ([]listener, error) {
+	listeners := make([]listener, 0)
+	ports := map[string]int{
+		xtproxy.ProtocolFTP:  ftpPort,
+		xtproxy.ProtocolTFTP: tftpPort,
+		xtproxy.ProtocolHTTP: httpPort,
+	}
+	for _, proto := range mountProtocols {
+		if len(ifacesListen) == 0 {
+			addr := netip.AddrPortFrom(defaultAddr, uint16(ports[proto]))
+			listeners = append(listeners, listener{Protocol: proto, Addr: addr})
 		}
-		for _, addr := range addrs {
-			ip := netIPAddr(addr).WithZone(ifaceName)
-			listenaddrs = append(listenaddrs, netip.AddrPortFrom(ip, uint16(ftpPort)))
-			listenaddrs = append(listenaddrs, netip.AddrPortFrom(ip, uint16(tftpPort)))
-			listenaddrs = append(listenaddrs, netip.AddrPortFrom(ip, uint16(httpPort)))
+		for _, ifaceName := range ifacesListen {
+			ifaceListeners, err := setupIfaceListeners(ifaceName, proto, ports[proto])
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, ifaceListeners...)
+		}
+	}
+	return listeners, nil
+}
+
+// setupIfaceListeners listens all addresses of the iface
+func setupIfaceListeners(ifaceName string, proto string, port int) ([]listener, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := netIPAddr(addr).WithZone(ifaceName)
+		listeners = append(listeners, listener{Protocol: proto, Addr: netip.AddrPortFrom(ip, uint16(port))})
+	}
+	return listeners, nil
+}
+
+// listenerOpts converts listeners to xtproxy options
+func listenerOpts(listeners []listener) ([]xtproxy.XTProxyOpt, error) {
+	opts := make([]xtproxy.XTProxyOpt, 0, len(listeners))
+	for _, l := range listeners {
+		switch l.Protocol {
+		case xtproxy.ProtocolFTP:
+			opts = append(opts, xtproxy.WithFTPAddr(net.TCPAddrFromAddrPort(l.Addr)))
+		case xtproxy.ProtocolTFTP:
+			opts = append(opts, xtproxy.WithTFTPAddr(net.UDPAddrFromAddrPort(l.Addr)))
+		case xtproxy.ProtocolHTTP:
+			opts = append(opts, xtproxy.WithHTTPAddr(net.TCPAddrFromAddrPort(l.Addr)))
+		default:
+			return nil, fmt.Errorf("unknown protocol %s: %w", l.Protocol, errUsage)
 		}
 	}
-	return listenaddrs, nil
+	return opts, nil
 }
 
 func netIPAddr(addr net.Addr) netip.Addr {
@@ -136,53 +318,55 @@ func masked(URL *url.URL) *url.URL {
 }
 
 func mainServe(args []string) error {
-	if len(args) == 0 {
+	if watchConfigFlag && configFlag == "" {
+		return fmt.Errorf("--watch-config requires --config: %w", errUsage)
+	}
+	if len(args) == 0 && configFlag == "" {
 		mountVal, ok := os.LookupEnv("XTPROXY_S3_MOUNTS")
 		if !ok {
-			return fmt.Errorf("missing mounts via args or XTPROXY_S3_MOUNTS=<url> <path>: %w", errUsage)
+			return fmt.Errorf("missing mounts via args, --config or XTPROXY_S3_MOUNTS=<url> <path> [options]: %w", errUsage)
 		}
 		args = []string{mountVal}
 	}
-	mounts, err := setupMountFs(args)
+	state := &serveState{
+		args:   args,
+		rootfs: aferomount.NewMountFS(afero.NewMemMapFs()),
+		mounts: make(map[string]mountFs),
+	}
+	mounts, opts, err := state.load()
 	if err != nil {
 		return err
 	}
-	rootfs := aferomount.NewMountFS(afero.NewMemMapFs())
-	if !writableFlag {
-		for i, m := range mounts {
-			mounts[i].Fs = afero.NewReadOnlyFs(m.Fs)
-		}
-	}
-	for _, m := range mounts {
-		log.Printf("mounts %s -> %s\n", masked(m.URL).String(), m.Path)
-		rootfs.Mount(m.Fs, m.Path)
+	if err := state.applyMounts(mounts); err != nil {
+		return err
 	}
-	listenaddrs, err := setupListenAddrs()
+	fproxy, err := xtproxy.NewXTProxy(state.rootfs, opts...)
 	if err != nil {
 		return err
 	}
-	opts := make([]xtproxy.XTProxyOpt, 0)
-	for _, addrport := range listenaddrs {
-		switch int(addrport.Port()) {
-		case ftpPort:
-			tcpaddr := net.TCPAddrFromAddrPort(addrport)
-			opts = append(opts, xtproxy.WithFTPAddr(tcpaddr))
-		case tftpPort:
-			udpaddr := net.UDPAddrFromAddrPort(addrport)
-			opts = append(opts, xtproxy.WithTFTPAddr(udpaddr))
-		case httpPort:
-			tcpaddr := net.TCPAddrFromAddrPort(addrport)
-			opts = append(opts, xtproxy.WithHTTPAddr(tcpaddr))
-		default:
-			return fmt.Errorf("unknown port %d: %s", int(addrport.Port()), errUsage)
-		}
+	state.proxy = fproxy
+	go state.reloadOnSignal()
+	if watchConfigFlag {
+		go state.reloadOnChange(configFlag)
 	}
-	fproxy, err := xtproxy.NewXTProxy(rootfs, opts...)
-	if err != nil {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		cancel() // second signal kills right away
+		log.Printf("shutting down, waiting up to %s for active transfers\n", shutdownTimeoutFlag)
+		sctx, scancel := context.WithTimeout(context.Background(), shutdownTimeoutFlag)
+		defer scancel()
+		shutdown <- fproxy.Shutdown(sctx)
+	}()
+	if err := fproxy.Run(context.Background()); err != nil {
 		return err
 	}
-	log.Printf("listens on %s\n", listenaddrs)
-	return fproxy.Wait()
+	if ctx.Err() == nil {
+		return nil
+	}
+	return <-shutdown
 }
 
 func main() {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"github.com/azryve/xtproxy/pkg/aferocache"
+	"github.com/azryve/xtproxy/pkg/aferomount"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var prefetchManifestFlag string
+var prefetchMountsFlag []string
+var prefetchWorkersFlag = 4
+
+var prefetchCmd = &cobra.Command{
+	Use:   "prefetch [pattern...]",
+	Short: "fetch files of mounts with cache option into the cache in advance",
+	Long: `Reads files matching patterns or listed in the manifest through the cache.
+Patterns match per path component, ** matches any number of components and
+a directory matches all the files under it.
+Checksums of fetched files are printed in sha256sum format, so the output
+can be used as a manifest verifying them on the next run.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return mainPrefetch(args)
+	},
+}
+
+func init() {
+	prefetchCmd.Flags().StringVar(&prefetchManifestFlag, "manifest", "", "file with paths to fetch one per line, optionally prefixed with sha256 to verify")
+	prefetchCmd.Flags().StringArrayVarP(&prefetchMountsFlag, "mount", "m", []string{}, "mount '<url> <path> [options]' in addition to --config")
+	prefetchCmd.Flags().IntVar(&prefetchWorkersFlag, "workers", prefetchWorkersFlag, "files fetched at once")
+	rootCmd.AddCommand(prefetchCmd)
+}
+
+func mainPrefetch(patterns []string) error {
+	if len(patterns) == 0 && prefetchManifestFlag == "" {
+		return fmt.Errorf("missing patterns or --manifest: %w", errUsage)
+	}
+	args := prefetchMountsFlag
+	if len(args) == 0 && configFlag == "" {
+		mountVal, ok := os.LookupEnv("XTPROXY_S3_MOUNTS")
+		if !ok {
+			return fmt.Errorf("missing mounts via --mount, --config or XTPROXY_S3_MOUNTS=<url> <path> [options]: %w", errUsage)
+		}
+		args = []string{mountVal}
+	}
+	state := &serveState{
+		args:   args,
+		rootfs: aferomount.NewMountFS(afero.NewMemMapFs()),
+		mounts: make(map[string]mountFs),
+	}
+	cfg, err := state.loadConfig()
+	if err != nil {
+		return err
+	}
+	mounts, err := state.loadMounts(cfg)
+	if err != nil {
+		return err
+	}
+	if state.cache == nil {
+		return fmt.Errorf("prefetch requires --cache-dir or cache in config: %w", errUsage)
+	}
+	// only cached mounts are walked, others would be read for nothing
+	mounts = slices.DeleteFunc(mounts, func(mnt mountFs) bool {
+		return !mnt.Cache
+	})
+	if len(mounts) == 0 {
+		return fmt.Errorf("no mounts with cache option: %w", errUsage)
+	}
+	if err := state.applyMounts(mounts); err != nil {
+		return err
+	}
+	files, err := prefetchFiles(state.rootfs, patterns)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	done := 0
+	err = aferocache.Prefetch(ctx, state.rootfs, files, prefetchWorkersFlag, func(res aferocache.PrefetchResult) {
+		done++
+		if res.Err != nil {
+			log.Printf("[%d/%d] %s failed: %s\n", done, len(files), res.Name, res.Err)
+			return
+		}
+		log.Printf("[%d/%d] %s %d bytes\n", done, len(files), res.Name, res.Size)
+		fmt.Printf("%s  %s\n", res.Sum, res.Name)
+	})
+	log.Printf("cache holds %d files of %d bytes\n", state.cache.Len(), state.cache.Size())
+	return err
+}
+
+// prefetchFiles lists files of the manifest followed by files matching patterns
+// each file is listed once
+func prefetchFiles(fs afero.Fs, patterns []string) ([]aferocache.PrefetchFile, error) {
+	files := make([]aferocache.PrefetchFile, 0)
+	if prefetchManifestFlag != "" {
+		manifest, err := os.Open(prefetchManifestFlag)
+		if err != nil {
+			return nil, err
+		}
+		defer manifest.Close()
+		if files, err = aferocache.ReadManifest(manifest); err != nil {
+			return nil, fmt.Errorf("%s: %w", prefetchManifestFlag, err)
+		}
+	}
+	for _, pattern := range patterns {
+		names, err := aferocache.Glob(fs, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern '%s': %w", pattern, err)
+		}
+		if len(names) == 0 {
+			log.Printf("pattern '%s' matches no files\n", pattern)
+		}
+		for _, name := range names {
+			files = append(files, aferocache.PrefetchFile{Name: name})
+		}
+	}
+	seen := make(map[string]struct{}, len(files))
+	return slices.DeleteFunc(files, func(file aferocache.PrefetchFile) bool {
+		_, ok := seen[file.Name]
+		seen[file.Name] = struct{}{}
+		return ok
+	}), nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/azryve/xtproxy/pkg/aferocache"
+	"github.com/azryve/xtproxy/pkg/aferomount"
+	"github.com/azryve/xtproxy/pkg/xtproxy"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDelay coalesces bursts of config file events into one reload
+var reloadDelay = 500 * time.Millisecond
+
+// serveState is the running configuration reloads are applied against
+type serveState struct {
+	mu     sync.Mutex
+	args   []string
+	rootfs *aferomount.MountFs
+	proxy  *xtproxy.XTProxy
+	mounts map[string]mountFs // running mounts by mountKey
+	cache  *aferocache.Cache  // opened on first load if configured
+}
+
+// load reads mounts and xtproxy options from config and args
+func (m *serveState) load() ([]mountFs, []xtproxy.XTProxyOpt, error) {
+	cfg, err := m.loadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	mounts, err := m.loadMounts(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	listeners, err := cfg.listeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(listeners) == 0 {
+		if listeners, err = setupListenAddrs(); err != nil {
+			return nil, nil, err
+		}
+	}
+	lopts, err := listenerOpts(listeners)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings, err := cfg.settings()
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("listens on %v\n", listeners)
+	return mounts, append(settings, lopts...), nil
+}
+
+// loadConfig reads the config file, empty config if not set
+func (m *serveState) loadConfig() (*config, error) {
+	if configFlag == "" {
+		return &config{}, nil
+	}
+	return loadConfig(configFlag)
+}
+
+// loadMounts returns mounts of config followed by args
+// opening the cache on first load, cache settings are not reloaded
+func (m *serveState) loadMounts(cfg *config) ([]mountFs, error) {
+	mounts, err := parseMountArgs(m.args)
+	if err != nil {
+		return nil, err
+	}
+	cacheCfg := cacheConfig{Dir: cacheDirFlag, Size: cacheSizeFlag}
+	if cfg.Cache.Dir != "" {
+		cacheCfg.Dir = cfg.Cache.Dir
+	}
+	if cfg.Cache.Size != "" {
+		cacheCfg.Size = cfg.Cache.Size
+	}
+	if m.cache == nil && cacheCfg.Dir != "" {
+		if m.cache, err = openCache(cacheCfg); err != nil {
+			return nil, err
+		}
+	}
+	return append(cfg.mounts(), mounts...), nil
+}
+
+func openCache(cfg cacheConfig) (*aferocache.Cache, error) {
+	size, err := parseByteSize(cfg.Size)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w: %w", err, errUsage)
+	}
+	cache, err := aferocache.NewDiskCache(cfg.Dir, size)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	log.Printf("cache %s holds %d files of %d bytes\n", cfg.Dir, cache.Len(), cache.Size())
+	return cache, nil
+}
+
+// applyMounts mounts new and unmounts missing mounts leaving unchanged intact,
+// replacements are mounted before the mounts they replace are unmounted
+// and files opened on unmounted fs are served until closed
+func (m *serveState) applyMounts(mounts []mountFs) error {
+	next := make(map[string]mountFs, len(mounts))
+	added := make([]mountFs, 0)
+	addedKeys := make([]string, 0)
+	for _, mnt := range mounts {
+		key := mountKey(mnt)
+		if running, ok := m.mounts[key]; ok {
+			next[key] = running
+			continue
+		}
+		next[key] = mnt
+		added = append(added, mnt)
+		addedKeys = append(addedKeys, key)
+	}
+	if err := setupMountFs(added, m.cache); err != nil {
+		return err
+	}
+	for i, mnt := range added {
+		log.Printf("mounts %s -> %s\n", masked(mnt.URL).String(), mnt.Path)
+		if err := m.rootfs.MountWithOptions(mnt.Fs, mnt.Path, mnt.Options); err != nil {
+			// running mounts are left as they were
+			for _, mounted := range added[:i] {
+				m.rootfs.UmountFs(mounted.Fs, mounted.Path)
+			}
+			return err
+		}
+	}
+	for i, mnt := range added {
+		m.mounts[addedKeys[i]] = mnt
+	}
+	var errs []error
+	for key, mnt := range m.mounts {
+		if _, ok := next[key]; ok {
+			continue
+		}
+		log.Printf("umounts %s -> %s\n", masked(mnt.URL).String(), mnt.Path)
+		if err := m.rootfs.UmountFs(mnt.Fs, mnt.Path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(m.mounts, key)
+	}
+	return errors.Join(errs...)
+}
+
+// mountKey identifies mount by its url with credentials, path and options
+func mountKey(mnt mountFs) string {
+	opts := mnt.Options
+	opts.Description = ""
+	return fmt.Sprintf("%s %s %+v cache=%t decompress=%t redirect=%s", mnt.URL, filepath.Join("/", mnt.Path), opts, mnt.Cache, mnt.Decompress, mnt.Redirect)
+}
+
+func (m *serveState) reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mounts, opts, err := m.load()
+	if err != nil {
+		return err
+	}
+	if err := m.applyMounts(mounts); err != nil {
+		return err
+	}
+	return m.proxy.Reload(opts...)
+}
+
+func (m *serveState) reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("reloading on SIGHUP\n")
+		if err := m.reload(); err != nil {
+			log.Printf("reload failed: %s\n", err)
+		}
+	}
+}
+
+// reloadOnChange watches the dir of the config to survive editors replacing the file
+func (m *serveState) reloadOnChange(path string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("watch config failed: %s\n", err)
+		return
+	}
+	defer watcher.Close()
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		log.Printf("watch config failed: %s\n", err)
+		return
+	}
+	var timer *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(reloadDelay, func() {
+				log.Printf("reloading on %s change\n", path)
+				if err := m.reload(); err != nil {
+					log.Printf("reload failed: %s\n", err)
+				}
+			})
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watch config: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/azryve/xtproxy/pkg/aferomount"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyMountsEnvCredentials(t *testing.T) {
+	t.Setenv("XTPROXY_S3_CREDENTIALS", "access:secret")
+	state := &serveState{rootfs: aferomount.NewMountFS(afero.NewMemMapFs()), mounts: make(map[string]mountFs)}
+	args := []string{"s3://s3.example.com/region-name/bucket /images"}
+	mounts, err := parseMountArgs(args)
+	assert.NoError(t, err)
+	assert.NoError(t, state.applyMounts(mounts))
+	running := state.rootfs.Lookup("/images")
+
+	// unchanged mount with credentials from env is kept on reload
+	mounts, err = parseMountArgs(args)
+	assert.NoError(t, err)
+	assert.NoError(t, state.applyMounts(mounts))
+	assert.Equal(t, running, state.rootfs.Lookup("/images"))
+	assert.Len(t, state.mounts, 1)
+}
+
+func TestApplyMountsReplace(t *testing.T) {
+	base := afero.NewMemMapFs()
+	assert.NoError(t, base.MkdirAll("/images", 0755))
+	state := &serveState{rootfs: aferomount.NewMountFS(afero.NewReadOnlyFs(base)), mounts: make(map[string]mountFs)}
+	apply := func(args ...string) error {
+		mounts, err := parseMountArgs(args)
+		assert.NoError(t, err)
+		return state.applyMounts(mounts)
+	}
+	v1, v2 := t.TempDir(), t.TempDir()
+	assert.NoError(t, apply(fmt.Sprintf("file://%s /images", v1)))
+	backends := func() []string {
+		var backends []string
+		for _, entry := range state.rootfs.Mounts() {
+			backends = append(backends, entry.Path+" "+entry.Backend)
+		}
+		return backends
+	}
+	assert.Equal(t, []string{"/images file://" + v1}, backends())
+
+	// a failing mount leaves running mounts as they were
+	err := apply(fmt.Sprintf("file://%s /images", v2), fmt.Sprintf("file://%s /missing", v2))
+	assert.Error(t, err)
+	assert.Equal(t, []string{"/images file://" + v1}, backends())
+	assert.Len(t, state.mounts, 1)
+
+	assert.NoError(t, apply(fmt.Sprintf("file://%s /images", v2)))
+	assert.Equal(t, []string{"/images file://" + v2}, backends())
+	assert.Len(t, state.mounts, 1)
+}
+
+func TestWatchConfigRequiresConfig(t *testing.T) {
+	watchConfigFlag = true
+	defer func() { watchConfigFlag = false }()
+	err := mainServe([]string{"file:///nonexistent /images"})
+	assert.ErrorIs(t, err, errUsage)
+	assert.Contains(t, err.Error(), "--watch-config requires --config")
+}
@@ -0,0 +1,536 @@
+package aferoarchive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Format of archive
+type Format string
+
+const (
+	Zip Format = "zip"
+	Tar Format = "tar" // plain or gzip compressed
+	ISO Format = "iso" // ISO 9660 with Rock Ridge names
+)
+
+// ArchiveFs is a read-only afero.Fs of files inside an archive on another fs,
+// the archive is indexed on first use and again once it changes
+type ArchiveFs struct {
+	fs      afero.Fs
+	name    string
+	format  Format
+	mu      sync.Mutex
+	entries map[string]*entry // by clean path, nil until indexed
+	stamp   stamp             // of the archive indexed
+}
+
+// stamp tells versions of the archive apart
+type stamp struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// member is a file or a dir found in the archive
+type member struct {
+	path    string // slash separated path inside the archive
+	dir     bool
+	link    string // target of symbolic or hard link members
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	open    func(archive afero.File) (reader, error)
+}
+
+// entry is a node of the tree of archive members
+type entry struct {
+	info     *FileInfo
+	children []*entry // of dirs sorted by name
+	open     func(archive afero.File) (reader, error)
+}
+
+// reader reads a member, compressed members are read sequentially
+type reader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// File is a member open in the archive
+type File struct {
+	name    string
+	entry   *entry
+	archive afero.File // own handle of the archive, nil for dirs
+	r       reader
+	dirAt   int
+	closed  bool
+}
+
+type FileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// indexers list members of archive of the size
+var indexers = map[Format]func(archive afero.File, size int64) ([]*member, error){
+	Zip: indexZip,
+	Tar: indexTar,
+	ISO: indexISO,
+}
+
+// maxLinks limits links followed to resolve a link member
+const maxLinks = 8
+
+func NewArchiveFs(fs afero.Fs, name string, format Format) (*ArchiveFs, error) {
+	if _, ok := indexers[format]; !ok {
+		return nil, fmt.Errorf("unknown archive format '%s'", format)
+	}
+	return &ArchiveFs{fs: fs, name: name, format: format}, nil
+}
+
+func (m *ArchiveFs) Name() string {
+	return "ArchiveFs"
+}
+
+// index reads the members of the archive, again once its size, modTime or ETag change
+func (m *ArchiveFs) index() (map[string]*entry, error) {
+	info, err := m.fs.Stat(m.name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries != nil && m.stamp == stampOf(info) {
+		return m.entries, nil
+	}
+	archive, err := m.fs.Open(m.name)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	return m.reindex(archive)
+}
+
+// indexOf returns the index of the version of the archive just opened,
+// members read through the handle are at offsets of that version
+func (m *ArchiveFs) indexOf(archive afero.File) (map[string]*entry, error) {
+	info, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries != nil && m.stamp == stampOf(info) {
+		return m.entries, nil
+	}
+	return m.reindex(archive)
+}
+
+// reindex lists members of the archive open while holding mu
+func (m *ArchiveFs) reindex(archive afero.File) (map[string]*entry, error) {
+	info, err := archive.Stat()
+	if err != nil {
+		return nil, err
+	}
+	members, err := indexers[m.format](archive, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s archive %s: %w", m.format, m.name, err)
+	}
+	m.entries = tree(members, info.ModTime())
+	m.stamp = stampOf(info)
+	return m.entries, nil
+}
+
+func stampOf(info os.FileInfo) stamp {
+	s := stamp{size: info.Size(), modTime: info.ModTime()}
+	type etager interface{ ETag() string }
+	if e, ok := info.(etager); ok {
+		s.etag = e.ETag()
+	} else if e, ok := info.Sys().(etager); ok {
+		s.etag = e.ETag()
+	}
+	return s
+}
+
+// tree builds the tree of members adding dirs missing in the archive,
+// links are resolved to the files they point to and dropped otherwise
+func tree(members []*member, modTime time.Time) map[string]*entry {
+	entries := map[string]*entry{
+		"/": {info: &FileInfo{name: "/", mode: os.ModeDir | 0555, modTime: modTime}},
+	}
+	var mkdir func(name string) *entry
+	mkdir = func(name string) *entry {
+		if e, ok := entries[name]; ok {
+			return e
+		}
+		e := &entry{info: &FileInfo{name: path.Base(name), mode: os.ModeDir | 0555, modTime: modTime}}
+		entries[name] = e
+		parent := mkdir(path.Dir(name))
+		parent.children = append(parent.children, e)
+		return e
+	}
+	add := func(name string, e *entry) {
+		if prev, ok := entries[name]; ok {
+			// later members replace earlier ones as tar extracts them
+			*prev.info = *e.info
+			prev.open = e.open
+			return
+		}
+		entries[name] = e
+		parent := mkdir(path.Dir(name))
+		parent.children = append(parent.children, e)
+	}
+	byPath := make(map[string]*member, len(members))
+	for _, mem := range members {
+		name := path.Clean("/" + mem.path)
+		if name == "/" || strings.Contains(mem.path, "\x00") {
+			continue
+		}
+		byPath[name] = mem
+		if mem.dir {
+			e := mkdir(name)
+			e.info.modTime = mem.modTime
+			continue
+		}
+		if mem.link == "" {
+			add(name, &entry{info: mem.info(path.Base(name)), open: mem.open})
+		}
+	}
+	for _, mem := range members {
+		if mem.link == "" {
+			continue
+		}
+		name := path.Clean("/" + mem.path)
+		target := mem
+		for i := 0; i < maxLinks && target != nil && target.link != ""; i++ {
+			target = byPath[linkTarget(path.Clean("/"+target.path), target.link)]
+		}
+		if target == nil || target.dir || target.link != "" {
+			continue
+		}
+		add(name, &entry{info: target.info(path.Base(name)), open: target.open})
+	}
+	for _, e := range entries {
+		sort.Slice(e.children, func(i, j int) bool { return e.children[i].info.name < e.children[j].info.name })
+	}
+	return entries
+}
+
+// linkTarget resolves link of the member name, symbolic links are relative
+// to the dir of the link while hard links of tar name archive members
+func linkTarget(name, link string) string {
+	if strings.HasPrefix(link, "/") {
+		return path.Clean(link)
+	}
+	return path.Clean(path.Join(path.Dir(name), link))
+}
+
+func (m *member) info(name string) *FileInfo {
+	return &FileInfo{name: name, size: m.size, mode: (m.mode.Perm() | 0444) &^ 0222, modTime: m.modTime}
+}
+
+// lookup finds the entry by name
+func (m *ArchiveFs) lookup(op, name string) (*entry, error) {
+	entries, err := m.index()
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	e, ok := entries[path.Clean("/"+filepath.ToSlash(name))]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (m *ArchiveFs) Stat(name string) (os.FileInfo, error) {
+	e, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (m *ArchiveFs) Open(name string) (afero.File, error) {
+	e, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		return &File{name: name, entry: e}, nil
+	}
+	archive, err := m.fs.Open(m.name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	entries, err := m.indexOf(archive)
+	if err != nil {
+		archive.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	e, ok := entries[path.Clean("/"+filepath.ToSlash(name))]
+	if !ok || e.info.IsDir() {
+		archive.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	r, err := e.open(archive)
+	if err != nil {
+		archive.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &File{name: name, entry: e, archive: archive, r: r}, nil
+}
+
+func (m *ArchiveFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	return m.Open(name)
+}
+
+func (m *ArchiveFs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) Rename(oldname, newname string) error {
+	return &os.PathError{Op: "rename", Path: oldname, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+func (m *ArchiveFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+func (m *File) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	if m.archive != nil {
+		return m.archive.Close()
+	}
+	return nil
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	if m.r == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.r.Read(p)
+}
+
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if m.r == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.r.ReadAt(p, off)
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	if m.r == nil {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.r.Seek(offset, whence)
+}
+
+func (m *File) Stat() (os.FileInfo, error) {
+	return m.entry.info, nil
+}
+
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	if m.r != nil {
+		return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+	}
+	rest := m.entry.children[m.dirAt:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(count, len(rest))]
+	}
+	m.dirAt += len(rest)
+	infos := make([]os.FileInfo, len(rest))
+	for i, e := range rest {
+		infos[i] = e.info
+	}
+	return infos, nil
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *FileInfo) Name() string {
+	return m.name
+}
+
+func (m *FileInfo) Size() int64 {
+	return m.size
+}
+
+func (m *FileInfo) Mode() os.FileMode {
+	return m.mode
+}
+
+func (m *FileInfo) ModTime() time.Time {
+	return m.modTime
+}
+
+func (m *FileInfo) IsDir() bool {
+	return m.mode.IsDir()
+}
+
+func (m *FileInfo) Sys() any {
+	return nil
+}
+
+// streamReader reads a compressed member decompressing from its start,
+// seeking backwards starts decompression over, open must not move the archive
+// handle so ReadAt can decompress apart from sequential reads
+type streamReader struct {
+	open   func() (io.Reader, error) // decompressed data of the member
+	size   int64
+	r      io.Reader
+	pos    int64 // position of r
+	offset int64 // position to read from
+}
+
+func (m *streamReader) Read(p []byte) (int, error) {
+	if m.offset >= m.size {
+		return 0, io.EOF
+	}
+	if m.r == nil || m.pos > m.offset {
+		r, err := m.open()
+		if err != nil {
+			return 0, err
+		}
+		m.r, m.pos = r, 0
+	}
+	if m.pos < m.offset {
+		n, err := io.CopyN(io.Discard, m.r, m.offset-m.pos)
+		m.pos += n
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	n, err := m.r.Read(p[:min(int64(len(p)), m.size-m.offset)])
+	m.pos += int64(n)
+	m.offset += int64(n)
+	if err == io.EOF && m.offset < m.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ReadAt decompresses the member from its start on each call
+// leaving the position of sequential reads as is
+func (m *streamReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("readat: negative offset")
+	}
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	r, err := m.open()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(io.Discard, r, off); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	n, err := io.ReadFull(r, p[:min(int64(len(p)), m.size-off)])
+	if err != nil {
+		return n, unexpectedEOF(err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
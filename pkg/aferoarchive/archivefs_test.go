@@ -0,0 +1,224 @@
+package aferoarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kdomanski/iso9660"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+var testFiles = map[string]string{
+	"boot/switch.bin":  strings.Repeat("switch image ", 1000),
+	"boot/cfg/a.conf":  "hostname a",
+	"readme.txt":       "readme",
+	"boot/cfg/b.conf":  "hostname b",
+	"boot/cfg/c.conf":  "hostname c",
+	"boot/cfg/d.conf":  "hostname d",
+	"boot/cfg/e.conf":  "hostname e",
+	"tools/flash.bin":  "flash",
+	"tools/erase.bin":  "erase",
+	"tools/verify.bin": "verify",
+}
+
+var testTime = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func zipForTest(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range testFiles {
+		method := zip.Deflate
+		if strings.HasPrefix(name, "tools/") {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: testTime})
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func tarForTest(t *testing.T, compress bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "boot/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: testTime}))
+	for name, data := range testFiles {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: testTime}))
+		_, err := tw.Write([]byte(data))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "boot/latest.bin", Typeflag: tar.TypeSymlink, Linkname: "switch.bin"}))
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "readme.md", Typeflag: tar.TypeLink, Linkname: "readme.txt"}))
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "escape.bin", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"}))
+	assert.NoError(t, tw.Close())
+	if gz != nil {
+		assert.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func isoForTest(t *testing.T) []byte {
+	iw, err := iso9660.NewWriter()
+	assert.NoError(t, err)
+	defer iw.Cleanup()
+	for name, data := range testFiles {
+		assert.NoError(t, iw.AddFile(strings.NewReader(data), name))
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, iw.WriteTo(&buf, "images"))
+	return buf.Bytes()
+}
+
+func TestArchiveFs(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		data   []byte
+	}{
+		{"images.zip", Zip, zipForTest(t)},
+		{"images.tar", Tar, tarForTest(t, false)},
+		{"images.tar.gz", Tar, tarForTest(t, true)},
+		{"images.iso", ISO, isoForTest(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memfs := afero.NewMemMapFs()
+			assert.NoError(t, afero.WriteFile(memfs, "/archives/"+tt.name, tt.data, 0644))
+			archfs, err := NewArchiveFs(memfs, "/archives/"+tt.name, tt.format)
+			assert.NoError(t, err)
+
+			for name, data := range testFiles {
+				got, err := afero.ReadFile(archfs, "/"+name)
+				assert.NoError(t, err, name)
+				assert.Equal(t, data, string(got), name)
+				info, err := archfs.Stat(name)
+				assert.NoError(t, err, name)
+				assert.Equal(t, int64(len(data)), info.Size(), name)
+				assert.False(t, info.IsDir(), name)
+				assert.Zero(t, info.Mode().Perm()&0222, name)
+			}
+
+			info, err := archfs.Stat("/boot/cfg")
+			assert.NoError(t, err)
+			assert.True(t, info.IsDir())
+			_, err = archfs.Stat("/boot/missing.bin")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			// listing by pages
+			dir, err := archfs.Open("/boot/cfg")
+			assert.NoError(t, err)
+			var names []string
+			for {
+				page, err := dir.Readdirnames(2)
+				if err == io.EOF {
+					break
+				}
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, len(page), 2)
+				names = append(names, page...)
+			}
+			assert.Equal(t, []string{"a.conf", "b.conf", "c.conf", "d.conf", "e.conf"}, names)
+			assert.NoError(t, dir.Close())
+
+			// random access
+			f, err := archfs.Open("/boot/switch.bin")
+			assert.NoError(t, err)
+			buf := make([]byte, 12)
+			_, err = f.ReadAt(buf, 13*500)
+			assert.NoError(t, err)
+			assert.Equal(t, "switch image", string(buf))
+			_, err = f.Seek(13*10+7, io.SeekStart)
+			assert.NoError(t, err)
+			_, err = io.ReadFull(f, buf[:5])
+			assert.NoError(t, err)
+			assert.Equal(t, "image", string(buf[:5]))
+			n, err := f.ReadAt(buf, 13*1000-6)
+			assert.Equal(t, 6, n)
+			assert.ErrorIs(t, err, io.EOF)
+			// ReadAt leaves sequential reads where they were
+			_, err = io.ReadFull(f, buf[:5])
+			assert.NoError(t, err)
+			assert.Equal(t, " swit", string(buf[:5]))
+			_, err = f.Write([]byte("x"))
+			assert.ErrorIs(t, err, syscall.EBADF)
+			assert.NoError(t, f.Close())
+
+			_, err = archfs.OpenFile("/readme.txt", os.O_WRONLY|os.O_TRUNC, 0644)
+			assert.ErrorIs(t, err, syscall.EPERM)
+			assert.ErrorIs(t, archfs.Remove("/readme.txt"), syscall.EPERM)
+		})
+	}
+}
+
+func TestArchiveFsLinks(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/images.tar", tarForTest(t, false), 0644))
+	archfs, err := NewArchiveFs(memfs, "/images.tar", Tar)
+	assert.NoError(t, err)
+	got, err := afero.ReadFile(archfs, "/boot/latest.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, testFiles["boot/switch.bin"], string(got))
+	got, err = afero.ReadFile(archfs, "/readme.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "readme", string(got))
+	_, err = archfs.Stat("/escape.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestArchiveFsChanged(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/images.tar", tarForTest(t, false), 0644))
+	archfs, err := NewArchiveFs(memfs, "/images.tar", Tar)
+	assert.NoError(t, err)
+	_, err = archfs.Stat("/readme.txt")
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "release.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 7, ModTime: testTime}))
+	_, err = tw.Write([]byte("release"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, afero.WriteFile(memfs, "/images.tar", buf.Bytes(), 0644))
+
+	_, err = archfs.Stat("/readme.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	got, err := afero.ReadFile(archfs, "/release.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "release", string(got))
+}
+
+func TestArchiveFsBroken(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/images.zip", []byte("not a zip"), 0644))
+	archfs, err := NewArchiveFs(memfs, "/images.zip", Zip)
+	assert.NoError(t, err)
+	_, err = archfs.Stat("/readme.txt")
+	assert.ErrorIs(t, err, zip.ErrFormat)
+
+	// indexed once the archive is fixed
+	assert.NoError(t, afero.WriteFile(memfs, "/images.zip", zipForTest(t), 0644))
+	_, err = archfs.Stat("/readme.txt")
+	assert.NoError(t, err)
+
+	_, err = NewArchiveFs(memfs, "/images.rar", Format("rar"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,221 @@
+package aferoarchive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/kdomanski/iso9660"
+	"github.com/spf13/afero"
+)
+
+// gzipMagic starts gzip streams
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// section reads members stored as is at offset of the archive
+func section(offset, size int64) func(archive afero.File) (reader, error) {
+	return func(archive afero.File) (reader, error) {
+		return io.NewSectionReader(archive, offset, size), nil
+	}
+}
+
+// indexZip lists zip members, stored ones are read at random
+// and deflated ones sequentially
+func indexZip(archive afero.File, size int64) ([]*member, error) {
+	zr, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]*member, 0, len(zr.File))
+	for _, zf := range zr.File {
+		info := zf.FileInfo()
+		mem := &member{
+			path:    zf.Name,
+			dir:     info.IsDir(),
+			size:    int64(zf.UncompressedSize64),
+			mode:    info.Mode(),
+			modTime: zf.Modified,
+		}
+		members = append(members, mem)
+		if mem.dir {
+			continue
+		}
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", zf.Name, err)
+		}
+		switch zf.Method {
+		case zip.Store:
+			mem.open = section(offset, mem.size)
+		case zip.Deflate:
+			compressed := int64(zf.CompressedSize64)
+			mem.open = func(archive afero.File) (reader, error) {
+				return &streamReader{size: mem.size, open: func() (io.Reader, error) {
+					return flate.NewReader(io.NewSectionReader(archive, offset, compressed)), nil
+				}}, nil
+			}
+		default:
+			mem.open = func(archive afero.File) (reader, error) {
+				return nil, fmt.Errorf("zip method %d: %w", zf.Method, zip.ErrAlgorithm)
+			}
+		}
+	}
+	return members, nil
+}
+
+// indexTar lists tar members, plain tar members are read at random
+// and ones of gzip compressed tar sequentially
+func indexTar(archive afero.File, size int64) ([]*member, error) {
+	magic := make([]byte, len(gzipMagic))
+	if _, err := archive.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		return indexTarGz(archive, size)
+	}
+	counter := &countingReader{r: archive}
+	return readTar(counter, func(hdr *tar.Header) func(archive afero.File) (reader, error) {
+		return section(counter.pos, hdr.Size)
+	})
+}
+
+// indexTarGz decompresses the whole archive once to list members,
+// reading a member decompresses the archive up to it
+func indexTarGz(archive afero.File, archiveSize int64) ([]*member, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: gz}
+	return readTar(counter, func(hdr *tar.Header) func(archive afero.File) (reader, error) {
+		offset, size := counter.pos, hdr.Size
+		return func(archive afero.File) (reader, error) {
+			return &streamReader{size: size, open: func() (io.Reader, error) {
+				gz, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(archive, 0, archiveSize)))
+				if err != nil {
+					return nil, err
+				}
+				if _, err := io.CopyN(io.Discard, gz, offset); err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				return gz, nil
+			}}, nil
+		}
+	})
+}
+
+// readTar lists members of tar stream, open makes reader of a regular
+// member from the header while the stream is at its data
+func readTar(counter *countingReader, open func(hdr *tar.Header) func(archive afero.File) (reader, error)) ([]*member, error) {
+	tr := tar.NewReader(counter)
+	members := make([]*member, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		mem := &member{
+			path:    hdr.Name,
+			size:    hdr.Size,
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mem.dir = true
+		case tar.TypeReg, tar.TypeRegA:
+			mem.open = open(hdr)
+		case tar.TypeSymlink:
+			mem.link = hdr.Linkname
+		case tar.TypeLink:
+			// hard links name members from the root of the archive
+			mem.link = "/" + hdr.Linkname
+		default:
+			continue // devices, fifos and sparse files
+		}
+		members = append(members, mem)
+	}
+}
+
+// indexISO lists files of ISO 9660 image, all of them are read at random
+func indexISO(archive afero.File, size int64) ([]*member, error) {
+	image, err := iso9660.OpenImage(archive)
+	if err != nil {
+		return nil, err
+	}
+	root, err := image.RootDir()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]*member, 0)
+	var walk func(dir string, f *iso9660.File) error
+	walk = func(dir string, f *iso9660.File) error {
+		children, err := f.GetChildren()
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			name := path.Join(dir, child.Name())
+			mem := &member{
+				path:    name,
+				dir:     child.IsDir(),
+				size:    child.Size(),
+				mode:    child.Mode() | 0444,
+				modTime: child.ModTime(),
+			}
+			members = append(members, mem)
+			if mem.dir {
+				if err := walk(name, child); err != nil {
+					return err
+				}
+				continue
+			}
+			sr, ok := child.Reader().(*io.SectionReader)
+			if !ok {
+				return fmt.Errorf("%s: unexpected reader", name)
+			}
+			_, offset, n := sr.Outer()
+			mem.open = section(offset, n)
+		}
+		return nil
+	}
+	if err := walk("/", root); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// countingReader tracks position in the stream, seeks of plain archives
+// let tar skip member data without reading it
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (m *countingReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.pos += int64(n)
+	return n, err
+}
+
+func (m *countingReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := m.r.(io.Seeker)
+	if !ok {
+		return 0, os.ErrInvalid
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err == nil {
+		m.pos = pos
+	}
+	return pos, err
+}
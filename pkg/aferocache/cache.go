@@ -0,0 +1,308 @@
+package aferocache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Cache keeps files fetched from slow backends on local storage
+// evicting least recently used ones to stay within maxSize
+// Entries survive restarts: every file is stored next to its metadata
+type Cache struct {
+	fs      afero.Fs // local storage
+	maxSize int64
+	mu      sync.Mutex               // guards fields below
+	entries map[string]*list.Element // of *entry by key
+	lru     *list.List               // most recently used first
+	size    int64                    // total size of cached files
+	fills   map[string]*fill         // in-flight fetches by key
+}
+
+// entry is a cached file with validators of the backend file it was fetched from
+type entry struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag,omitempty"`
+}
+
+// ETager is implemented by FileInfo (or its Sys) of backends knowing entity tags
+type ETager interface {
+	ETag() string
+}
+
+const (
+	metaSuffix = ".json"
+	tempSuffix = ".tmp"
+)
+
+// NewCache creates a cache stored in fs picking up entries already there
+func NewCache(fs afero.Fs, maxSize int64) (*Cache, error) {
+	m := &Cache{
+		fs:      fs,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		fills:   make(map[string]*fill),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewDiskCache creates a cache in dir creating it if needed
+func NewDiskCache(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return NewCache(afero.NewBasePathFs(afero.NewOsFs(), dir), maxSize)
+}
+
+// Size returns total size of cached files
+func (m *Cache) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// Len returns number of cached files
+func (m *Cache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// load reads entries left by the previous run dropping incomplete ones
+func (m *Cache) load() error {
+	infos, err := afero.ReadDir(m.fs, "/")
+	if err != nil {
+		return err
+	}
+	type loaded struct {
+		entry *entry
+		used  time.Time
+	}
+	found := make([]loaded, 0)
+	data := make(map[string]os.FileInfo)
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), metaSuffix) && !strings.HasSuffix(info.Name(), tempSuffix) {
+			data[info.Name()] = info
+		}
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, tempSuffix) {
+			m.fs.Remove(name)
+			continue
+		}
+		if !strings.HasSuffix(name, metaSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(name, metaSuffix)
+		e, err := m.readMeta(name)
+		dataInfo, ok := data[id]
+		if err != nil || !ok || dataInfo.Size() != e.Size || entryID(e.Key) != id {
+			m.fs.Remove(name)
+			continue
+		}
+		delete(data, id)
+		found = append(found, loaded{e, dataInfo.ModTime()})
+	}
+	for id := range data {
+		m.fs.Remove(id)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].used.After(found[j].used)
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range found {
+		m.entries[l.entry.Key] = m.lru.PushBack(l.entry)
+		m.size += l.entry.Size
+	}
+	m.evictLocked(0)
+	return nil
+}
+
+func (m *Cache) readMeta(name string) (*entry, error) {
+	raw, err := afero.ReadFile(m.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{}
+	if err := json.Unmarshal(raw, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// open returns the cached file for key if it is still valid for backend info
+func (m *Cache) open(key string, info os.FileInfo) (afero.File, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		if el, ok = m.adoptLocked(key); !ok {
+			return nil, false
+		}
+	}
+	e := el.Value.(*entry)
+	if !e.valid(info) {
+		m.removeLocked(el)
+		return nil, false
+	}
+	id := entryID(key)
+	file, err := m.fs.Open(id)
+	if err != nil {
+		m.removeLocked(el)
+		return nil, false
+	}
+	now := time.Now()
+	m.fs.Chtimes(id, now, now) // keeps lru order across restarts
+	m.lru.MoveToFront(el)
+	return file, true
+}
+
+// adoptLocked picks up an entry stored by another process sharing the storage
+// like prefetch running next to the server
+func (m *Cache) adoptLocked(key string) (*list.Element, bool) {
+	id := entryID(key)
+	e, err := m.readMeta(id + metaSuffix)
+	if err != nil || e.Key != key {
+		return nil, false
+	}
+	if info, err := m.fs.Stat(id); err != nil || info.Size() != e.Size {
+		return nil, false
+	}
+	el := m.lru.PushFront(e)
+	m.entries[key] = el
+	m.size += e.Size
+	m.evictLocked(0)
+	return el, m.entries[key] == el
+}
+
+// create returns a temporary file to fetch key into, committed with commit
+func (m *Cache) create(key string, info os.FileInfo) (afero.File, error) {
+	if info.Size() > m.maxSize {
+		return nil, errors.New("file exceeds cache size")
+	}
+	return afero.TempFile(m.fs, "/", entryID(key)+".*"+tempSuffix)
+}
+
+// commit makes filled temporary file the cached file for key
+func (m *Cache) commit(key string, info os.FileInfo, tmp afero.File) error {
+	tmpName := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		m.fs.Remove(tmpName)
+		return err
+	}
+	e := newEntry(key, info)
+	meta, err := json.Marshal(e)
+	if err != nil {
+		m.fs.Remove(tmpName)
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.removeLocked(el)
+	}
+	m.evictLocked(e.Size)
+	id := entryID(key)
+	if err := m.fs.Rename(tmpName, id); err != nil {
+		m.fs.Remove(tmpName)
+		return err
+	}
+	if err := afero.WriteFile(m.fs, id+metaSuffix, meta, 0644); err != nil {
+		m.fs.Remove(id)
+		return err
+	}
+	m.entries[key] = m.lru.PushFront(e)
+	m.size += e.Size
+	return nil
+}
+
+// abort drops a temporary file which will not be committed
+func (m *Cache) abort(tmp afero.File) {
+	name := tmp.Name()
+	tmp.Close()
+	m.fs.Remove(name)
+}
+
+// remove drops cached files of key and of all the paths under it,
+// in-flight fetches of them are served to their readers but not cached
+func (m *Cache) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	under := func(k string) bool {
+		return k == key || strings.HasPrefix(k, strings.TrimSuffix(key, "/")+"/")
+	}
+	for k, el := range m.entries {
+		if under(k) {
+			m.removeLocked(el)
+		}
+	}
+	for k := range m.fills {
+		if under(k) {
+			delete(m.fills, k)
+		}
+	}
+}
+
+// evictLocked drops least recently used files to fit extra bytes
+func (m *Cache) evictLocked(extra int64) {
+	for m.size+extra > m.maxSize && m.lru.Len() > 0 {
+		m.removeLocked(m.lru.Back())
+	}
+}
+
+// removeLocked drops the cached file, readers having it open continue reading
+func (m *Cache) removeLocked(el *list.Element) {
+	e := m.lru.Remove(el).(*entry)
+	delete(m.entries, e.Key)
+	m.size -= e.Size
+	id := entryID(e.Key)
+	m.fs.Remove(id + metaSuffix)
+	m.fs.Remove(id)
+}
+
+func newEntry(key string, info os.FileInfo) *entry {
+	return &entry{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		ETag:    etag(info),
+	}
+}
+
+// valid reports whether backend file has not changed since it was cached
+func (m *entry) valid(info os.FileInfo) bool {
+	return m.Size == info.Size() && m.ModTime.Equal(info.ModTime()) && m.ETag == etag(info)
+}
+
+func etag(info os.FileInfo) string {
+	if e, ok := info.(ETager); ok {
+		return e.ETag()
+	}
+	if e, ok := info.Sys().(ETager); ok {
+		return e.ETag()
+	}
+	return ""
+}
+
+// entryID is a file name for key in the local storage
+func entryID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
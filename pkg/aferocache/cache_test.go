@@ -0,0 +1,401 @@
+package aferocache
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadThrough(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/dir/file.bin", []byte("file contents"), 0644))
+	cache, err := NewCache(afero.NewMemMapFs(), 1024)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	for i := 0; i < 3; i++ {
+		contents, err := afero.ReadFile(fs, "/dir/file.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, "file contents", string(contents))
+	}
+	assert.Equal(t, int32(1), backend.opens.Load())
+	assert.Equal(t, int64(13), cache.Size())
+
+	// cached copy is seekable and reports backend name
+	file, err := fs.Open("/dir/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dir/file.bin", file.Name())
+	buf := make([]byte, 8)
+	n, err := file.ReadAt(buf, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "contents", string(buf[:n]))
+	assert.NoError(t, file.Close())
+	assert.Equal(t, int32(1), backend.opens.Load())
+
+	// changed backend file is fetched again
+	mtime := time.Now().Add(time.Hour)
+	assert.NoError(t, backend.Fs.Chtimes("/dir/file.bin", mtime, mtime))
+	_, err = afero.ReadFile(fs, "/dir/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), backend.opens.Load())
+
+	// writes invalidate
+	assert.NoError(t, afero.WriteFile(fs, "/dir/file.bin", []byte("new"), 0644))
+	assert.Equal(t, 0, cache.Len())
+	contents, err := afero.ReadFile(fs, "/dir/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(contents))
+}
+
+func TestPartialRead(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/file.bin", []byte("file contents"), 0644))
+	cache, err := NewCache(afero.NewMemMapFs(), 1024)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	// fetch continues after the reader is gone
+	file, err := fs.Open("/file.bin")
+	assert.NoError(t, err)
+	_, err = file.Read(make([]byte, 4))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	file, err = fs.Open("/file.bin")
+	assert.NoError(t, err)
+	_, err = file.Seek(5, io.SeekStart)
+	assert.NoError(t, err)
+	contents, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "contents", string(contents))
+	assert.NoError(t, file.Close())
+	assert.Eventually(t, func() bool { return cache.Len() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), backend.opens.Load())
+}
+
+func TestCoalesce(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs(), release: make(chan struct{})}
+	contents := strings.Repeat("0123456789", 100000)
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/file.bin", []byte(contents), 0644))
+	cache, err := NewCache(afero.NewMemMapFs(), 1<<20)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	// readers get bytes as they arrive
+	first, err := fs.Open("/file.bin")
+	assert.NoError(t, err)
+	backend.release <- struct{}{}
+	buf := make([]byte, 16)
+	n, err := first.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, contents[:n], string(buf[:n]))
+
+	results := make(chan string)
+	for i := 0; i < 10; i++ {
+		go func() {
+			data, err := afero.ReadFile(fs, "/file.bin")
+			assert.NoError(t, err)
+			results <- string(data)
+		}()
+	}
+	close(backend.release)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, contents, <-results)
+	}
+	rest, err := io.ReadAll(first)
+	assert.NoError(t, err)
+	assert.Equal(t, contents[n:], string(rest))
+	assert.NoError(t, first.Close())
+	assert.Equal(t, int32(1), backend.opens.Load())
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestCoalesceConcurrentOpens(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs(), delay: 20 * time.Millisecond}
+	contents := strings.Repeat("0123456789", 100000)
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/file.bin", []byte(contents), 0644))
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/other.bin", []byte(contents), 0644))
+	cache, err := NewCache(afero.NewMemMapFs(), 1<<20)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	// opens arriving together before the backend answered the first one
+	barrier := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-barrier
+			data, err := afero.ReadFile(fs, "/file.bin")
+			assert.NoError(t, err)
+			assert.Equal(t, contents, string(data))
+		}()
+	}
+	close(barrier)
+	wg.Wait()
+	assert.Equal(t, int32(1), backend.opens.Load())
+	assert.Equal(t, 1, cache.Len())
+
+	// opens waiting for a failed one get its error
+	barrier = make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-barrier
+			_, err := fs.Open("/other.bin")
+			assert.Error(t, err)
+		}()
+	}
+	assert.NoError(t, backend.Fs.Chmod("/other.bin", 0))
+	backend.Fs = &failingOpenFs{Fs: backend.Fs}
+	close(barrier)
+	wg.Wait()
+	assert.Equal(t, int32(2), backend.opens.Load())
+	assert.Equal(t, 0, len(cache.fills))
+}
+
+func TestFillStorageFull(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs(), release: make(chan struct{})}
+	contents := strings.Repeat("0123456789", 100000)
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/file.bin", []byte(contents), 0644))
+	cache, err := NewCache(&fullFs{Fs: afero.NewMemMapFs(), limit: 300000}, 1<<20)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	// bytes the storage did not take are an error, not the end of the file
+	file, err := fs.Open("/file.bin")
+	assert.NoError(t, err)
+	close(backend.release)
+	got, err := io.ReadAll(file)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, contents[:len(got)], string(got))
+	assert.Less(t, len(got), len(contents))
+	_, err = file.ReadAt(make([]byte, 100), 299950)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.NoError(t, file.Close())
+	assert.Equal(t, 0, cache.Len())
+}
+
+// fullFs runs out of space once limit bytes are written to a file
+type fullFs struct {
+	afero.Fs
+	limit int
+}
+
+type fullFile struct {
+	afero.File
+	left int
+}
+
+func (m *fullFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := m.Fs.OpenFile(name, flag, perm)
+	if err != nil || flag == os.O_RDONLY {
+		return file, err
+	}
+	return &fullFile{File: file, left: m.limit}, nil
+}
+
+func (m *fullFile) Write(p []byte) (int, error) {
+	n, err := m.File.Write(p[:min(len(p), m.left)])
+	m.left -= n
+	if err == nil && n < len(p) {
+		err = &os.PathError{Op: "write", Path: m.Name(), Err: syscall.ENOSPC}
+	}
+	return n, err
+}
+
+// failingOpenFs fails opening files for reading
+type failingOpenFs struct {
+	afero.Fs
+}
+
+func (m *failingOpenFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrDeadlineExceeded}
+}
+
+// unknownSizeFs reports files of unknown size as some http servers do
+type unknownSizeFs struct {
+	afero.Fs
+}
+
+type unknownSizeInfo struct {
+	os.FileInfo
+}
+
+func (m unknownSizeFs) Stat(name string) (os.FileInfo, error) {
+	info, err := m.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return unknownSizeInfo{info}, nil
+}
+
+func (m unknownSizeInfo) Size() int64 {
+	return -1
+}
+
+func TestUnknownSizeNotCached(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(backend, "/file.bin", []byte("file contents"), 0644))
+	cache, err := NewCache(afero.NewMemMapFs(), 1024)
+	assert.NoError(t, err)
+	fs := NewCacheFs(unknownSizeFs{backend}, cache, "backend")
+	for i := 0; i < 2; i++ {
+		got, err := afero.ReadFile(fs, "/file.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, "file contents", string(got))
+	}
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestEviction(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	for _, name := range []string{"/a", "/b", "/c", "/big"} {
+		size := 4
+		if name == "/big" {
+			size = 16
+		}
+		assert.NoError(t, afero.WriteFile(backend, name, make([]byte, size), 0644))
+	}
+	storage := afero.NewMemMapFs()
+	cache, err := NewCache(storage, 10)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	read := func(name string) {
+		_, err := afero.ReadFile(fs, name)
+		assert.NoError(t, err)
+	}
+	read("/a")
+	read("/b")
+	read("/a")
+	read("/c")
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, int64(8), cache.Size())
+	_, ok := cache.entries[fs.key("/b")]
+	assert.False(t, ok, "least recently used is evicted")
+
+	// larger than the cache is served but not stored
+	read("/big")
+	assert.Equal(t, 2, cache.Len())
+
+	// entries are picked up by a new cache on the same storage
+	reopened, err := NewCache(storage, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reopened.Len())
+	assert.Equal(t, int64(8), reopened.Size())
+	infos, err := afero.ReadDir(storage, "/")
+	assert.NoError(t, err)
+	assert.Len(t, infos, 4, "data and metadata of each entry")
+}
+
+// countingFs counts files opened for reading taking delay to open them,
+// with release set every read waits for it
+type countingFs struct {
+	afero.Fs
+	opens   atomic.Int32
+	delay   time.Duration
+	release chan struct{}
+}
+
+type releaseFile struct {
+	afero.File
+	release chan struct{}
+}
+
+func (m *countingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag != os.O_RDONLY {
+		return m.Fs.OpenFile(name, flag, perm)
+	}
+	m.opens.Add(1)
+	time.Sleep(m.delay)
+	file, err := m.Fs.OpenFile(name, flag, perm)
+	if err != nil || m.release == nil {
+		return file, err
+	}
+	return &releaseFile{File: file, release: m.release}, nil
+}
+
+func (m *releaseFile) Read(p []byte) (int, error) {
+	<-m.release
+	return m.File.Read(p)
+}
+
+func (m *countingFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func TestPrefetch(t *testing.T) {
+	backend := afero.NewMemMapFs()
+	for _, name := range []string{"/images/a.bin", "/images/b.bin", "/images/old/c.bin", "/configs/d.txt"} {
+		assert.NoError(t, afero.WriteFile(backend, name, []byte(name), 0644))
+	}
+	cache, err := NewCache(afero.NewMemMapFs(), 1024)
+	assert.NoError(t, err)
+	fs := NewCacheFs(backend, cache, "backend")
+
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"/images/*.bin", []string{"/images/a.bin", "/images/b.bin"}},
+		{"/images", []string{"/images/a.bin", "/images/b.bin", "/images/old/c.bin"}},
+		{"/**/c.bin", []string{"/images/old/c.bin"}},
+		{"/*/d.txt", []string{"/configs/d.txt"}},
+	}
+	for _, tt := range tests {
+		names, err := Glob(fs, tt.pattern)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, names, tt.pattern)
+	}
+
+	manifest := `
+# images for the window
+a0b3f9a4c7d1e6f6c0c1a1e8d7c4e3c1d8a0b3f9a4c7d1e6f6c0c1a1e8d7c4e3  images/a.bin
+/images/b.bin
+/images/missing.bin
+`
+	files, err := ReadManifest(strings.NewReader(manifest))
+	assert.NoError(t, err)
+	assert.Equal(t, "/images/a.bin", files[0].Name)
+	results := make(map[string]PrefetchResult)
+	err = Prefetch(context.Background(), fs, files, 2, func(res PrefetchResult) {
+		results[res.Name] = res
+	})
+	assert.EqualError(t, err, "2 of 3 files failed")
+	assert.EqualError(t, results["/images/a.bin"].Err, "checksum mismatch expected a0b3f9a4c7d1e6f6c0c1a1e8d7c4e3c1d8a0b3f9a4c7d1e6f6c0c1a1e8d7c4e3")
+	assert.NoError(t, results["/images/b.bin"].Err)
+	assert.Equal(t, int64(13), results["/images/b.bin"].Size)
+	assert.Equal(t, "fcdc166cb4492d60cc6e46f3157eff531103db65f68972f7a75a1ffa9cdea9f6", results["/images/b.bin"].Sum)
+	assert.ErrorIs(t, results["/images/missing.bin"].Err, os.ErrNotExist)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestSharedStorage(t *testing.T) {
+	backend := &countingFs{Fs: afero.NewMemMapFs()}
+	assert.NoError(t, afero.WriteFile(backend.Fs, "/file.bin", []byte("file contents"), 0644))
+	storage := afero.NewMemMapFs()
+	server, err := NewCache(storage, 1024)
+	assert.NoError(t, err)
+	prefetch, err := NewCache(storage, 1024)
+	assert.NoError(t, err)
+
+	_, err = afero.ReadFile(NewCacheFs(backend, prefetch, "backend"), "/file.bin")
+	assert.NoError(t, err)
+	contents, err := afero.ReadFile(NewCacheFs(backend, server, "backend"), "/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "file contents", string(contents))
+	assert.Equal(t, int32(1), backend.opens.Load())
+	assert.Equal(t, 1, server.Len())
+}
@@ -0,0 +1,102 @@
+package aferocache
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// CacheFs is a read-through cache of Fs: files are fetched into the cache
+// and served from it while the backend Stat reports them unchanged,
+// concurrent opens of a file being fetched share the fetch
+// Writes go to Fs directly invalidating the cached copy
+type CacheFs struct {
+	afero.Fs
+	cache     *Cache
+	namespace string // separates backends sharing the cache
+}
+
+// cachedFile is a cached copy reporting name and stat of the backend file
+type cachedFile struct {
+	afero.File
+	name string
+	info os.FileInfo
+}
+
+func NewCacheFs(fs afero.Fs, cache *Cache, namespace string) *CacheFs {
+	return &CacheFs{Fs: fs, cache: cache, namespace: namespace}
+}
+
+func (m *CacheFs) Name() string {
+	return "CacheFs"
+}
+
+func (m *CacheFs) key(name string) string {
+	return m.namespace + filepath.Join("/", name)
+}
+
+func (m *CacheFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *CacheFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if isWriteFlag(flag) {
+		m.cache.remove(m.key(name))
+		return m.Fs.OpenFile(name, flag, perm)
+	}
+	info, err := m.Fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	// files of unknown size can not be checked to be fetched completely
+	if !info.Mode().IsRegular() || info.Size() < 0 {
+		return m.Fs.OpenFile(name, flag, perm)
+	}
+	key := m.key(name)
+	if file, ok := m.cache.open(key, info); ok {
+		return &cachedFile{File: file, name: name, info: info}, nil
+	}
+	return m.cache.fill(key, name, info, func() (afero.File, error) {
+		return m.Fs.OpenFile(name, flag, perm)
+	})
+}
+
+func (m *CacheFs) Create(name string) (afero.File, error) {
+	m.cache.remove(m.key(name))
+	return m.Fs.Create(name)
+}
+
+func (m *CacheFs) Remove(name string) error {
+	m.cache.remove(m.key(name))
+	return m.Fs.Remove(name)
+}
+
+func (m *CacheFs) RemoveAll(name string) error {
+	m.cache.remove(m.key(name))
+	return m.Fs.RemoveAll(name)
+}
+
+func (m *CacheFs) Rename(oldname, newname string) error {
+	m.cache.remove(m.key(oldname))
+	m.cache.remove(m.key(newname))
+	return m.Fs.Rename(oldname, newname)
+}
+
+func (m *CacheFs) Chtimes(name string, atime, mtime time.Time) error {
+	m.cache.remove(m.key(name))
+	return m.Fs.Chtimes(name, atime, mtime)
+}
+
+func isWriteFlag(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
+}
+
+func (m *cachedFile) Name() string {
+	return m.name
+}
+
+func (m *cachedFile) Stat() (os.FileInfo, error) {
+	return m.info, nil
+}
@@ -0,0 +1,250 @@
+package aferocache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// fillBufferSize is the size of reads from the backend
+var fillBufferSize = 256 << 10
+
+// fill fetches a backend file into the cache once for all its readers,
+// readers are served from the temporary file as bytes arrive
+type fill struct {
+	cache   *Cache
+	key     string
+	info    os.FileInfo
+	ready   chan struct{} // closed once the fetch started or failed to
+	openErr error         // of opening the backend file
+	direct  bool          // not cached, readers open the backend file themselves
+	tmp     afero.File    // written by run only
+	tmpName string        // the cached file once committed
+	mu      sync.Mutex    // guards written, err and tmpName once started
+	cond    *sync.Cond    // broadcasts progress
+	written int64
+	err     error // io.EOF once fetched completely
+}
+
+// fillFile reads a file being fetched, waiting for bytes not yet fetched
+type fillFile struct {
+	afero.File // read handle of the temporary file
+	fill       *fill
+	name       string
+	offset     int64
+}
+
+// fill returns a reader of an in-flight fetch of key starting a new one if needed,
+// files not fitting the cache are opened from the backend as is
+func (m *Cache) fill(key string, name string, info os.FileInfo, open func() (afero.File, error)) (afero.File, error) {
+	m.mu.Lock()
+	f, ok := m.fills[key]
+	if !ok || !newEntry(key, f.info).valid(info) {
+		// registered before opening the backend so opens arriving meanwhile wait for it
+		f = &fill{cache: m, key: key, info: info, ready: make(chan struct{})}
+		f.cond = sync.NewCond(&f.mu)
+		m.fills[key] = f
+		m.mu.Unlock()
+		return f.start(name, open)
+	}
+	m.mu.Unlock()
+	<-f.ready
+	if f.openErr != nil {
+		return nil, f.openErr
+	}
+	if !f.direct {
+		if file, err := f.open(name); err == nil {
+			return file, nil
+		}
+	}
+	return open()
+}
+
+// start opens the backend file and fetches it in background
+// releasing the opens waiting for the fill once started
+func (m *fill) start(name string, open func() (afero.File, error)) (afero.File, error) {
+	defer close(m.ready)
+	src, err := open()
+	if err != nil {
+		m.openErr = err
+		m.cache.dropFill(m)
+		return nil, err
+	}
+	tmp, err := m.cache.create(m.key, m.info)
+	if err != nil {
+		m.direct = true
+		m.cache.dropFill(m)
+		return src, nil
+	}
+	m.tmp, m.tmpName = tmp, tmp.Name()
+	file, err := m.open(name)
+	if err != nil {
+		src.Close()
+		m.cache.abort(tmp)
+		m.direct = true
+		m.cache.dropFill(m)
+		return nil, err
+	}
+	go m.run(src)
+	return file, nil
+}
+
+// dropFill forgets the fill unless replaced by a newer one
+func (m *Cache) dropFill(f *fill) {
+	m.mu.Lock()
+	if m.fills[f.key] == f {
+		delete(m.fills, f.key)
+	}
+	m.mu.Unlock()
+}
+
+// run copies the backend file to the temporary one and commits it to the cache
+// the fetch continues even if all the readers are gone to keep the copy
+func (m *fill) run(src afero.File) {
+	defer src.Close()
+	buf := make([]byte, fillBufferSize)
+	var err error
+	for err == nil {
+		var n int
+		n, err = src.Read(buf)
+		if n > 0 {
+			var werr error
+			if n, werr = m.tmp.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+		m.mu.Lock()
+		m.written += int64(n)
+		if err != nil && err != io.EOF {
+			// readers woken up past the bytes written get the error, not the end of file
+			m.err = err
+		}
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	}
+	m.cache.mu.Lock()
+	current := m.cache.fills[m.key] == m
+	if current {
+		delete(m.cache.fills, m.key)
+	}
+	m.cache.mu.Unlock()
+	if err == io.EOF && m.written != m.info.Size() {
+		err = errors.New("backend file size differs from stat")
+	}
+	if err == io.EOF && current {
+		// readers opening the fill meanwhile open either of the files
+		m.mu.Lock()
+		if m.cache.commit(m.key, m.info, m.tmp) == nil {
+			m.tmpName = entryID(m.key)
+		}
+		m.mu.Unlock()
+	} else {
+		m.cache.abort(m.tmp)
+	}
+	m.mu.Lock()
+	m.err = err
+	m.cond.Broadcast()
+	m.mu.Unlock()
+}
+
+// open returns a new reader of the fill
+func (m *fill) open(name string) (afero.File, error) {
+	m.mu.Lock()
+	file, err := m.cache.fs.Open(m.tmpName)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return &fillFile{File: file, fill: m, name: name}, nil
+}
+
+// wait blocks until bytes up to end are fetched or the fetch is over
+// returning the number of bytes fetched
+func (m *fill) wait(end int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.written < end && m.err == nil {
+		m.cond.Wait()
+	}
+	return m.written, m.err
+}
+
+func (m *fillFile) Name() string {
+	return m.name
+}
+
+func (m *fillFile) Stat() (os.FileInfo, error) {
+	return m.fill.info, nil
+}
+
+func (m *fillFile) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	written, err := m.fill.wait(m.offset + 1)
+	if m.offset >= written {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	if int64(len(p)) > written-m.offset {
+		p = p[:written-m.offset]
+	}
+	n, rerr := m.File.ReadAt(p, m.offset)
+	m.offset += int64(n)
+	return n, shortRead(n, len(p), rerr, nil)
+}
+
+func (m *fillFile) ReadAt(p []byte, off int64) (int, error) {
+	written, err := m.fill.wait(off + int64(len(p)))
+	if off+int64(len(p)) <= written {
+		n, rerr := m.File.ReadAt(p, off)
+		return n, shortRead(n, len(p), rerr, rerr)
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	if off >= written {
+		return 0, io.EOF
+	}
+	n, rerr := m.File.ReadAt(p[:written-off], off)
+	return n, shortRead(n, int(written-off), rerr, io.EOF)
+}
+
+// shortRead returns err of reading n bytes of the want fetched ones,
+// the temporary file ending before them is never the end of the file
+func shortRead(n, want int, err, full error) error {
+	switch {
+	case n < want && (err == nil || err == io.EOF):
+		return io.ErrUnexpectedEOF
+	case n == want && (err == nil || err == io.EOF):
+		return full
+	}
+	return err
+}
+
+func (m *fillFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.fill.info.Size()
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *fillFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (m *fillFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrPermission
+}
@@ -0,0 +1,185 @@
+package aferocache
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// PrefetchFile is a file to read through the cache
+type PrefetchFile struct {
+	Name   string
+	SHA256 string // expected checksum, empty skips verification
+}
+
+// PrefetchResult reports a file read through the cache
+type PrefetchResult struct {
+	PrefetchFile
+	Size int64
+	Sum  string // sha256 of the contents read
+	Err  error
+}
+
+// Prefetch reads files of fs to the end so cached mounts store them,
+// workers files are read at once and each is passed to report once done
+func Prefetch(ctx context.Context, fs afero.Fs, files []PrefetchFile, workers int, report func(PrefetchResult)) error {
+	if workers < 1 {
+		workers = 1
+	}
+	mu := sync.Mutex{} // serializes report
+	failed := 0
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for _, file := range files {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			res := prefetch(ctx, fs, file)
+			mu.Lock()
+			defer mu.Unlock()
+			if res.Err != nil {
+				failed++
+			}
+			if report != nil {
+				report(res)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return ctx.Err()
+}
+
+func prefetch(ctx context.Context, fs afero.Fs, pf PrefetchFile) PrefetchResult {
+	res := PrefetchResult{PrefetchFile: pf}
+	if res.Err = ctx.Err(); res.Err != nil {
+		return res
+	}
+	file, err := fs.Open(pf.Name)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer file.Close()
+	hash := sha256.New()
+	res.Size, res.Err = io.Copy(hash, &contextReader{ctx: ctx, r: file})
+	if res.Err != nil {
+		return res
+	}
+	res.Sum = hex.EncodeToString(hash.Sum(nil))
+	if pf.SHA256 != "" && !strings.EqualFold(pf.SHA256, res.Sum) {
+		res.Err = fmt.Errorf("checksum mismatch expected %s", pf.SHA256)
+	}
+	return res
+}
+
+// contextReader stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (m *contextReader) Read(p []byte) (int, error) {
+	if err := m.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.r.Read(p)
+}
+
+// Glob returns regular files matching pattern or placed in dirs matching it,
+// pattern is matched per path component as in filepath.Match, ** matches any number of them
+func Glob(fs afero.Fs, pattern string) ([]string, error) {
+	pattern = filepath.Join("/", pattern)
+	parts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	root := "/"
+	for i, part := range parts {
+		if strings.ContainsAny(part, `*?[\`) {
+			break
+		}
+		root = "/" + strings.Join(parts[:i+1], "/")
+	}
+	if _, err := fs.Stat(root); err != nil {
+		return nil, err
+	}
+	matches := make([]string, 0)
+	err := afero.Walk(fs, root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		names := strings.Split(strings.TrimPrefix(filepath.Join("/", name), "/"), "/")
+		for i := range names {
+			if ok, err := matchParts(parts, names[:i+1]); err != nil {
+				return err
+			} else if ok {
+				matches = append(matches, filepath.Join("/", name))
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+func matchParts(pattern, names []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(names) == 0, nil
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if ok, err := matchParts(pattern[1:], names[i:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	if len(names) == 0 {
+		return false, nil
+	}
+	ok, err := filepath.Match(pattern[0], names[0])
+	if !ok || err != nil {
+		return false, err
+	}
+	return matchParts(pattern[1:], names[1:])
+}
+
+// ReadManifest parses a list of files one per line, either a path alone
+// or prefixed with sha256 in sha256sum format, # starts a comment
+func ReadManifest(r io.Reader) ([]PrefetchFile, error) {
+	files := make([]PrefetchFile, 0)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		file := PrefetchFile{Name: line}
+		if sum, name, ok := strings.Cut(line, " "); ok && len(sum) == sha256.Size*2 {
+			if _, err := hex.DecodeString(sum); err != nil {
+				return nil, fmt.Errorf("line %d: invalid sha256 '%s'", lineno, sum)
+			}
+			name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+			file = PrefetchFile{Name: name, SHA256: sum}
+		}
+		file.Name = filepath.Join("/", file.Name)
+		files = append(files, file)
+	}
+	return files, scanner.Err()
+}
@@ -0,0 +1,367 @@
+package aferodecompress
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/ulikunitz/xz"
+)
+
+// DecompressFs serves files missing in Fs decompressed from their
+// compressed copies, <name>.gz, <name>.xz or <name>.zst, the first found wins
+// Writes go to Fs as is
+type DecompressFs struct {
+	afero.Fs
+	mu    sync.Mutex
+	sizes map[string]*decompressedSize // by name of the compressed file
+}
+
+// decompressedSize of the compressed file of the size and time,
+// Stats arriving while it is counted wait for it
+type decompressedSize struct {
+	size    int64
+	modTime time.Time
+	ready   chan struct{} // closed once n or err is set
+	n       int64
+	err     error
+}
+
+// decompressor makes reader of decompressed data
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// exts of compressed copies in order they are looked up
+var exts = []string{".gz", ".xz", ".zst"}
+
+var decompressors = map[string]decompressor{
+	".gz": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	".xz": func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	},
+	".zst": func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+}
+
+// File is a compressed file read decompressed, reads are sequential,
+// seeking backwards decompresses from the start again
+type File struct {
+	compressed afero.File
+	name       string
+	decompress decompressor
+	info       *FileInfo
+	r          io.ReadCloser
+	pos        int64 // position of r
+	offset     int64 // position to read from
+}
+
+// FileInfo is stat of the compressed file with the name and size of decompressed one
+type FileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func NewDecompressFs(fs afero.Fs) *DecompressFs {
+	return &DecompressFs{Fs: fs, sizes: make(map[string]*decompressedSize)}
+}
+
+func (m *DecompressFs) Name() string {
+	return "DecompressFs"
+}
+
+// lookup finds the compressed copy of missing name
+func (m *DecompressFs) lookup(name string) (string, *FileInfo, error) {
+	for _, ext := range exts {
+		info, err := m.Fs.Stat(name + ext)
+		if errors.Is(err, fs.ErrNotExist) {
+			m.forget(name + ext)
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if !info.Mode().IsRegular() {
+			m.forget(name + ext)
+			continue
+		}
+		size, err := m.size(name+ext, info)
+		if err != nil {
+			return "", nil, err
+		}
+		return name + ext, &FileInfo{FileInfo: info, name: strings.TrimSuffix(info.Name(), ext), size: size}, nil
+	}
+	return "", nil, fs.ErrNotExist
+}
+
+func (m *DecompressFs) Stat(name string) (os.FileInfo, error) {
+	info, err := m.Fs.Stat(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+	_, decompressed, err := m.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return decompressed, nil
+}
+
+// size reads the decompressed size once per version of the compressed file,
+// from the xz index or zstd frame headers, otherwise by decompressing it
+func (m *DecompressFs) size(compressed string, info os.FileInfo) (int64, error) {
+	m.mu.Lock()
+	known, ok := m.sizes[compressed]
+	if !ok || known.size != info.Size() || !known.modTime.Equal(info.ModTime()) {
+		known = &decompressedSize{size: info.Size(), modTime: info.ModTime(), ready: make(chan struct{})}
+		m.sizes[compressed] = known
+		m.mu.Unlock()
+		known.n, known.err = m.count(compressed, info.Size())
+		if known.err != nil {
+			m.mu.Lock()
+			if m.sizes[compressed] == known {
+				delete(m.sizes, compressed)
+			}
+			m.mu.Unlock()
+		}
+		close(known.ready)
+		return known.n, known.err
+	}
+	m.mu.Unlock()
+	<-known.ready
+	return known.n, known.err
+}
+
+// forget drops the size of compressed file gone or replaced by a dir
+func (m *DecompressFs) forget(compressed string) {
+	m.mu.Lock()
+	delete(m.sizes, compressed)
+	m.mu.Unlock()
+}
+
+// forgetAll drops sizes of name and files under it
+func (m *DecompressFs) forgetAll(name string) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	for compressed := range m.sizes {
+		if compressed == name || strings.HasPrefix(compressed, strings.TrimSuffix(name, "/")+"/") {
+			delete(m.sizes, compressed)
+		}
+	}
+	m.mu.Unlock()
+}
+
+func (m *DecompressFs) Remove(name string) error {
+	m.forget(name)
+	return m.Fs.Remove(name)
+}
+
+func (m *DecompressFs) RemoveAll(name string) error {
+	m.forgetAll(name)
+	return m.Fs.RemoveAll(name)
+}
+
+func (m *DecompressFs) Rename(oldname, newname string) error {
+	m.forgetAll(oldname)
+	return m.Fs.Rename(oldname, newname)
+}
+
+// count reads the decompressed size of the compressed file of the size
+func (m *DecompressFs) count(compressed string, size int64) (int64, error) {
+	ext := extOf(compressed)
+	if sizer, ok := sizers[ext]; ok {
+		f, err := m.Fs.Open(compressed)
+		if err != nil {
+			return 0, err
+		}
+		n, err := sizer(f, size)
+		f.Close()
+		if err == nil {
+			return n, nil
+		}
+	}
+	f, err := m.Fs.Open(compressed)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r, err := decompressors[ext](f)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(io.Discard, r)
+}
+
+func (m *DecompressFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *DecompressFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := m.Fs.OpenFile(name, flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 || !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	compressed, info, err := m.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f, err := m.Fs.Open(compressed)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &File{compressed: f, name: name, decompress: decompressors[extOf(compressed)], info: info}, nil
+}
+
+func extOf(name string) string {
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+func (m *File) Close() error {
+	if m.r != nil {
+		m.r.Close()
+	}
+	return m.compressed.Close()
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	if m.offset >= m.info.size {
+		return 0, io.EOF
+	}
+	if m.r == nil || m.pos > m.offset {
+		if err := m.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	if m.pos < m.offset {
+		n, err := io.CopyN(io.Discard, m.r, m.offset-m.pos)
+		m.pos += n
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	n, err := m.r.Read(p[:min(int64(len(p)), m.info.size-m.offset)])
+	m.pos += int64(n)
+	m.offset += int64(n)
+	if err == io.EOF && m.offset < m.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// reopen starts decompression from the start of the file
+func (m *File) reopen() error {
+	if m.r != nil {
+		m.r.Close()
+		m.r = nil
+	}
+	if _, err := m.compressed.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := m.decompress(m.compressed)
+	if err != nil {
+		return err
+	}
+	m.r, m.pos = r, 0
+	return nil
+}
+
+// ReadAt moves the position of sequential reads
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := m.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(m, p)
+	if err == io.ErrUnexpectedEOF && m.offset >= m.info.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: m.Name(), Err: syscall.EINVAL}
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *File) Stat() (os.FileInfo, error) {
+	return m.info, nil
+}
+
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: m.Name(), Err: syscall.ENOTDIR}
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdir", Path: m.Name(), Err: syscall.ENOTDIR}
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.Name(), Err: syscall.EBADF}
+}
+
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.Name(), Err: syscall.EBADF}
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.Name(), Err: syscall.EBADF}
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.Name(), Err: syscall.EBADF}
+}
+
+func (m *FileInfo) Name() string {
+	return m.name
+}
+
+func (m *FileInfo) Size() int64 {
+	return m.size
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
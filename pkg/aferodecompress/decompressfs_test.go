@@ -0,0 +1,238 @@
+package aferodecompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func compressForTest(t *testing.T, ext string, data string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch ext {
+	case ".gz":
+		w = gzip.NewWriter(&buf)
+	case ".xz":
+		w, err = xz.NewWriter(&buf)
+	case ".zst":
+		w, err = zstd.NewWriter(&buf)
+	}
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(data))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDecompressFs(t *testing.T) {
+	image := strings.Repeat("switch image ", 10000)
+	for _, ext := range exts {
+		t.Run(ext, func(t *testing.T) {
+			memfs := afero.NewMemMapFs()
+			assert.NoError(t, afero.WriteFile(memfs, "/images/switch.bin"+ext, compressForTest(t, ext, image), 0644))
+			dfs := NewDecompressFs(memfs)
+
+			info, err := dfs.Stat("/images/switch.bin")
+			assert.NoError(t, err)
+			assert.Equal(t, "switch.bin", info.Name())
+			assert.Equal(t, int64(len(image)), info.Size())
+			got, err := afero.ReadFile(dfs, "/images/switch.bin")
+			assert.NoError(t, err)
+			assert.Equal(t, image, string(got))
+
+			// compressed copy is served as is too
+			info, err = dfs.Stat("/images/switch.bin" + ext)
+			assert.NoError(t, err)
+			assert.Less(t, info.Size(), int64(len(image)))
+
+			f, err := dfs.Open("/images/switch.bin")
+			assert.NoError(t, err)
+			buf := make([]byte, 12)
+			_, err = f.ReadAt(buf, 13*5000)
+			assert.NoError(t, err)
+			assert.Equal(t, "switch image", string(buf))
+			_, err = f.ReadAt(buf, 13*10+7)
+			assert.NoError(t, err)
+			assert.Equal(t, "image switch", string(buf))
+			n, err := f.ReadAt(buf, int64(len(image))-6)
+			assert.Equal(t, 6, n)
+			assert.ErrorIs(t, err, io.EOF)
+			size, err := f.Seek(0, io.SeekEnd)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(image)), size)
+			_, err = f.Write([]byte("x"))
+			assert.ErrorIs(t, err, syscall.EBADF)
+			assert.NoError(t, f.Close())
+		})
+	}
+}
+
+func TestDecompressFsLookup(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	dfs := NewDecompressFs(memfs)
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.gz", compressForTest(t, ".gz", "gzip image"), 0644))
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.zst", compressForTest(t, ".zst", "zstd image"), 0644))
+	got, err := afero.ReadFile(dfs, "/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip image", string(got))
+
+	// size is counted again once the compressed file changes
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.gz", compressForTest(t, ".gz", "newer gzip image"), 0644))
+	info, err := dfs.Stat("/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("newer gzip image")), info.Size())
+
+	// plain file wins
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin", []byte("plain image"), 0644))
+	got, err = afero.ReadFile(dfs, "/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain image", string(got))
+
+	_, err = dfs.Stat("/missing.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = dfs.Open("/missing.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// writes create plain files
+	assert.NoError(t, afero.WriteFile(dfs, "/router.bin", []byte("router image"), 0644))
+	_, err = memfs.Stat("/router.bin")
+	assert.NoError(t, err)
+
+	// corrupted copy
+	assert.NoError(t, afero.WriteFile(memfs, "/broken.bin.xz", []byte("not xz"), 0644))
+	_, err = dfs.Open("/broken.bin")
+	assert.Error(t, err)
+	assert.NoError(t, memfs.Remove("/switch.bin"))
+	_, err = dfs.OpenFile("/switch.bin", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+}
+
+// countDecompressForTest counts files decompressed, each taking delay to start
+func countDecompressForTest(t *testing.T, delay time.Duration) *atomic.Int32 {
+	var count atomic.Int32
+	saved := make(map[string]decompressor, len(decompressors))
+	for ext, decompress := range decompressors {
+		saved[ext] = decompress
+		decompressors[ext] = func(r io.Reader) (io.ReadCloser, error) {
+			count.Add(1)
+			time.Sleep(delay)
+			return decompress(r)
+		}
+	}
+	t.Cleanup(func() {
+		for ext, decompress := range saved {
+			decompressors[ext] = decompress
+		}
+	})
+	return &count
+}
+
+func TestDecompressSizeRecorded(t *testing.T) {
+	first, second := strings.Repeat("switch image ", 10000), strings.Repeat("router image ", 3000)
+	// concatenated streams with padding between them
+	xzData := append(compressForTest(t, ".xz", first), 0, 0, 0, 0)
+	xzData = append(xzData, compressForTest(t, ".xz", second)...)
+	enc, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	zstdData := enc.EncodeAll([]byte(first), nil)
+	zstdData = enc.EncodeAll([]byte(second), zstdData)
+	assert.NoError(t, enc.Close())
+
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.xz", xzData, 0644))
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.zst", zstdData, 0644))
+	dfs := NewDecompressFs(memfs)
+	decompressed := countDecompressForTest(t, 0)
+	for _, name := range []string{"/switch.bin.xz", "/switch.bin.zst"} {
+		f, err := memfs.Open(name)
+		assert.NoError(t, err)
+		info, err := f.Stat()
+		assert.NoError(t, err)
+		n, err := sizers[extOf(name)](f, info.Size())
+		assert.NoError(t, err, name)
+		assert.Equal(t, int64(len(first)+len(second)), n, name)
+		assert.NoError(t, f.Close())
+	}
+	info, err := dfs.Stat("/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(first)+len(second)), info.Size())
+	assert.Zero(t, decompressed.Load())
+	got, err := afero.ReadFile(dfs, "/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, first+second, string(got))
+
+	// zstd frames without content size are counted by decompressing
+	assert.NoError(t, memfs.Remove("/switch.bin.xz"))
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	assert.NoError(t, err)
+	_, err = zw.Write([]byte(first))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.zst", buf.Bytes(), 0644))
+	info, err = dfs.Stat("/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(first)), info.Size())
+	assert.Equal(t, int32(1), decompressed.Load())
+}
+
+func TestDecompressSizeCoalesced(t *testing.T) {
+	image := strings.Repeat("switch image ", 10000)
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/switch.bin.gz", compressForTest(t, ".gz", image), 0644))
+	dfs := NewDecompressFs(memfs)
+	decompressed := countDecompressForTest(t, 50*time.Millisecond)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			info, err := dfs.Stat("/switch.bin")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(image)), info.Size())
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, int32(1), decompressed.Load())
+}
+
+func TestDecompressSizeForgotten(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	for _, name := range []string{"/a.bin.gz", "/b.bin.gz", "/dir/c.bin.gz"} {
+		assert.NoError(t, afero.WriteFile(memfs, name, compressForTest(t, ".gz", name), 0644))
+	}
+	dfs := NewDecompressFs(memfs)
+	for _, name := range []string{"/a.bin", "/b.bin", "/dir/c.bin"} {
+		_, err := dfs.Stat(name)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, dfs.sizes, 3)
+
+	// sizes of compressed files gone are dropped
+	assert.NoError(t, memfs.Remove("/a.bin.gz"))
+	_, err := dfs.Stat("/a.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Len(t, dfs.sizes, 2)
+	assert.NoError(t, dfs.Rename("/b.bin.gz", "/b2.bin.gz"))
+	assert.Len(t, dfs.sizes, 1)
+	assert.NoError(t, dfs.RemoveAll("/dir"))
+	assert.Len(t, dfs.sizes, 0)
+}
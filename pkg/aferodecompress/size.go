@@ -0,0 +1,157 @@
+package aferodecompress
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+)
+
+// sizer reads the decompressed size a format records without decompressing,
+// errors fall back to decompressing the whole file
+type sizer func(f afero.File, size int64) (int64, error)
+
+// sizers of formats recording decompressed sizes, gzip keeps it modulo 4GiB
+// per member so gzip files are decompressed to be counted
+var sizers = map[string]sizer{
+	".xz":  xzSize,
+	".zst": zstdSize,
+}
+
+var errNoSize = errors.New("decompressed size is not recorded")
+
+// xzSize sums uncompressed sizes of blocks listed in the index of each stream
+// going from the last stream backwards
+func xzSize(f afero.File, size int64) (int64, error) {
+	const headerLen, footerLen = 12, 12
+	var n int64
+	end := size
+	for end > 0 {
+		footer := make([]byte, footerLen)
+		// streams may be followed by padding of zero bytes in multiples of 4
+		for {
+			if end < headerLen+footerLen {
+				return 0, errNoSize
+			}
+			if _, err := f.ReadAt(footer[:4], end-4); err != nil {
+				return 0, err
+			}
+			if !bytes.Equal(footer[:4], []byte{0, 0, 0, 0}) {
+				break
+			}
+			end -= 4
+		}
+		if _, err := f.ReadAt(footer, end-footerLen); err != nil {
+			return 0, err
+		}
+		if string(footer[10:]) != "YZ" {
+			return 0, errNoSize
+		}
+		indexLen := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+		if indexLen > end-headerLen-footerLen {
+			return 0, errNoSize
+		}
+		index := make([]byte, indexLen)
+		if _, err := f.ReadAt(index, end-footerLen-indexLen); err != nil {
+			return 0, err
+		}
+		if index[0] != 0 {
+			return 0, errNoSize
+		}
+		p := index[1:]
+		records, err := uvarint(&p)
+		if err != nil {
+			return 0, err
+		}
+		var blocks int64
+		for i := uint64(0); i < records; i++ {
+			unpadded, err := uvarint(&p)
+			if err != nil {
+				return 0, err
+			}
+			uncompressed, err := uvarint(&p)
+			if err != nil {
+				return 0, err
+			}
+			blocks += (int64(unpadded) + 3) &^ 3
+			n += int64(uncompressed)
+		}
+		end -= headerLen + blocks + indexLen + footerLen
+		if end < 0 || n < 0 {
+			return 0, errNoSize
+		}
+	}
+	return n, nil
+}
+
+// uvarint takes a multibyte integer of xz off p
+func uvarint(p *[]byte) (uint64, error) {
+	v, n := binary.Uvarint(*p)
+	if n <= 0 {
+		return 0, errNoSize
+	}
+	*p = (*p)[n:]
+	return v, nil
+}
+
+// zstdSize sums Frame_Content_Size of the frames, the compressed data
+// is read once to find where frames end but is not decompressed
+func zstdSize(f afero.File, size int64) (int64, error) {
+	br := bufio.NewReader(f)
+	var n int64
+	for {
+		hdr, err := br.Peek(zstd.HeaderMaxSize)
+		if len(hdr) == 0 && err == io.EOF {
+			return n, nil
+		}
+		var h zstd.Header
+		if err := h.Decode(hdr); err != nil {
+			return 0, err
+		}
+		if h.Skippable {
+			if err := discard(br, int64(h.HeaderSize)+int64(h.SkippableSize)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if !h.HasFCS {
+			return 0, errNoSize
+		}
+		n += int64(h.FrameContentSize)
+		if err := discard(br, int64(h.HeaderSize)); err != nil {
+			return 0, err
+		}
+		for last := false; !last; {
+			var block [3]byte
+			if _, err := io.ReadFull(br, block[:]); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			v := uint32(block[0]) | uint32(block[1])<<8 | uint32(block[2])<<16
+			last = v&1 == 1
+			payload := int64(v >> 3)
+			switch (v >> 1) & 3 {
+			case 1: // RLE stores the byte repeated
+				payload = 1
+			case 3:
+				return 0, errNoSize
+			}
+			if err := discard(br, payload); err != nil {
+				return 0, err
+			}
+		}
+		if h.HasCheckSum {
+			if err := discard(br, 4); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func discard(br *bufio.Reader, n int64) error {
+	_, err := io.CopyN(io.Discard, br, n)
+	return unexpectedEOF(err)
+}
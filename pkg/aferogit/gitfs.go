@@ -0,0 +1,542 @@
+package aferogit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/spf13/afero"
+)
+
+// GitFs is a read-only afero.Fs of the tree of a branch, tag or commit,
+// with poll set the ref is checked again in the background once poll passed
+// since the last check and the tree is switched to the new commit it points to
+type GitFs struct {
+	load       func(current *snapshot) (*snapshot, error)
+	poll       time.Duration
+	loadMu     sync.Mutex // one load of the ref at a time
+	snapMu     sync.Mutex // guards current, checked and refreshing
+	current    *snapshot
+	checked    time.Time
+	refreshing bool
+	mu         sync.Mutex // serializes reads of repository objects
+}
+
+// snapshot is the tree of a commit of the repository
+type snapshot struct {
+	repo  *git.Repository
+	state string // refs of the remote the commit was resolved from
+	hash  plumbing.Hash
+	tree  *object.Tree
+	when  time.Time // commit time reported as modification time of files
+}
+
+// File is a file read into memory or a dir of the tree
+type File struct {
+	name   string
+	info   *FileInfo
+	r      *bytes.Reader // nil for dirs
+	dir    []os.FileInfo
+	dirAt  int
+	closed bool
+}
+
+// FileInfo of tree entries, blob hash serves as ETag
+type FileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	hash    plumbing.Hash
+}
+
+// maxLinks limits symbolic links followed to resolve a tree entry
+const maxLinks = 8
+
+// NewLocalGitFs reads the repository at dir, reopening it on every poll
+func NewLocalGitFs(dir, ref string, poll time.Duration) *GitFs {
+	return &GitFs{poll: poll, load: func(current *snapshot) (*snapshot, error) {
+		repo, err := git.PlainOpen(dir)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", dir, err)
+		}
+		hash, err := resolve(repo, ref)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", dir, err)
+		}
+		if current != nil && current.hash == hash {
+			return current, nil
+		}
+		return newSnapshot(repo, hash, "")
+	}}
+}
+
+// NewRemoteGitFs fetches the commit of ref without history into memory,
+// on poll a changed ref is fetched into a new storage replacing the snapshot
+// so objects of commits no longer served are freed with the snapshot
+func NewRemoteGitFs(url string, auth transport.AuthMethod, ref string, poll time.Duration) *GitFs {
+	cfg := &config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}}
+	lister := git.NewRemote(memory.NewStorage(), cfg)
+	return &GitFs{poll: poll, load: func(current *snapshot) (*snapshot, error) {
+		refs, err := lister.List(&git.ListOptions{Auth: auth})
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", url, err)
+		}
+		state := refState(refs, ref)
+		if current != nil && current.state == state {
+			return current, nil
+		}
+		spec, rev, err := fetchSpec(refs, ref)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", url, err)
+		}
+		storage := memory.NewStorage()
+		repo, err := git.Init(storage, nil)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", url, err)
+		}
+		remote := git.NewRemote(storage, cfg)
+		err = remote.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{spec}, Depth: 1, Auth: auth, Force: true})
+		if errors.Is(err, git.ErrExactSHA1NotSupported) {
+			// servers refusing commits by hash send all the history once, commits never move
+			err = remote.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"+refs/*:refs/*"}, Auth: auth, Force: true})
+		}
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil, fmt.Errorf("git %s: %w", url, err)
+		}
+		hash, err := resolve(repo, rev)
+		if err != nil {
+			return nil, fmt.Errorf("git %s: %w", url, err)
+		}
+		return newSnapshot(repo, hash, state)
+	}}
+}
+
+// fetchSpec finds the remote ref to fetch for ref the way git resolves names,
+// the ref itself, a tag then a branch, commit hashes are fetched as they are
+func fetchSpec(refs []*plumbing.Reference, ref string) (config.RefSpec, string, error) {
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.ReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+		plumbing.NewBranchReferenceName(ref),
+	} {
+		r, ok := byName[name]
+		if ok && r.Type() == plumbing.SymbolicReference {
+			r, ok = byName[r.Target()]
+		}
+		if ok && r.Type() == plumbing.HashReference {
+			return config.RefSpec(fmt.Sprintf("+%s:%s", r.Name(), r.Name())), r.Name().String(), nil
+		}
+	}
+	if plumbing.IsHash(ref) {
+		return config.RefSpec(ref + ":refs/xtproxy/pinned"), ref, nil
+	}
+	return "", "", fmt.Errorf("ref %s: %w", ref, plumbing.ErrReferenceNotFound)
+}
+
+// refState lists refs the ref may name with their hashes,
+// refs of none are commits which never change
+func refState(refs []*plumbing.Reference, ref string) string {
+	names := map[plumbing.ReferenceName]bool{
+		plumbing.ReferenceName(ref):          true,
+		plumbing.NewBranchReferenceName(ref): true,
+		plumbing.NewTagReferenceName(ref):    true,
+	}
+	for _, r := range refs {
+		if names[r.Name()] && r.Type() == plumbing.SymbolicReference {
+			names[r.Target()] = true
+		}
+	}
+	var state []string
+	for _, r := range refs {
+		if names[r.Name()] && r.Type() == plumbing.HashReference {
+			state = append(state, r.Name().String()+" "+r.Hash().String())
+		}
+	}
+	if len(state) == 0 {
+		return ref
+	}
+	sort.Strings(state)
+	return strings.Join(state, "\n")
+}
+
+// resolve finds the commit of branch, tag or commit hash ref
+func resolve(repo *git.Repository, ref string) (plumbing.Hash, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("ref %s: %w", ref, err)
+	}
+	return *hash, nil
+}
+
+func newSnapshot(repo *git.Repository, hash plumbing.Hash, state string) (*snapshot, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{repo: repo, state: state, hash: hash, tree: tree, when: commit.Committer.When}, nil
+}
+
+func (m *GitFs) Name() string {
+	return "GitFs"
+}
+
+// snapshot returns the tree loaded before, once poll passed the ref is checked
+// in the background while reads keep the current tree
+func (m *GitFs) snapshot() (*snapshot, error) {
+	m.snapMu.Lock()
+	if current := m.current; current != nil {
+		if m.poll > 0 && !m.refreshing && time.Since(m.checked) >= m.poll {
+			m.refreshing = true
+			go m.refresh(current)
+		}
+		m.snapMu.Unlock()
+		return current, nil
+	}
+	m.snapMu.Unlock()
+	// the first load is waited for as there is nothing to serve before it
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+	m.snapMu.Lock()
+	current := m.current
+	m.snapMu.Unlock()
+	if current != nil {
+		return current, nil
+	}
+	next, err := m.load(nil)
+	if err != nil {
+		return nil, err
+	}
+	m.snapMu.Lock()
+	m.current, m.checked = next, time.Now()
+	m.snapMu.Unlock()
+	return next, nil
+}
+
+// refresh checks the ref swapping the tree, failed checks keep the tree loaded before
+func (m *GitFs) refresh(current *snapshot) {
+	m.loadMu.Lock()
+	next, err := m.load(current)
+	m.loadMu.Unlock()
+	m.snapMu.Lock()
+	defer m.snapMu.Unlock()
+	m.refreshing, m.checked = false, time.Now()
+	if err != nil {
+		log.Printf("%s, serving commit %s", err, current.hash)
+		return
+	}
+	m.current = next
+}
+
+// lookup finds the entry of name following symbolic links inside the tree
+func (m *GitFs) lookup(op, name string) (*snapshot, string, *FileInfo, error) {
+	snap, err := m.snapshot()
+	if err != nil {
+		return nil, "", nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clean := path.Clean("/" + filepath.ToSlash(name))
+	resolved, info, err := snap.resolve(clean)
+	if err != nil {
+		return nil, "", nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	if resolved != clean {
+		// links are named as themselves
+		link := *info
+		link.name = path.Base(clean)
+		info = &link
+	}
+	return snap, resolved, info, nil
+}
+
+// resolve finds the entry of clean name returning the path links lead to
+func (m *snapshot) resolve(name string) (string, *FileInfo, error) {
+	for i := 0; i <= maxLinks; i++ {
+		if name == "/" {
+			return name, &FileInfo{name: "/", mode: os.ModeDir | 0555, modTime: m.when, hash: m.tree.Hash}, nil
+		}
+		entry, err := m.tree.FindEntry(name[1:])
+		if err != nil {
+			return "", nil, fs.ErrNotExist
+		}
+		if entry.Mode != filemode.Symlink {
+			info, err := m.info(path.Base(name), entry)
+			return name, info, err
+		}
+		target, err := m.blob(entry.Hash)
+		if err != nil {
+			return "", nil, err
+		}
+		link := string(target)
+		if !strings.HasPrefix(link, "/") {
+			link = path.Join(path.Dir(name), link)
+		}
+		name = path.Clean(link)
+	}
+	return "", nil, syscall.ELOOP
+}
+
+// info describes entry, submodules are not part of the tree
+func (m *snapshot) info(name string, entry *object.TreeEntry) (*FileInfo, error) {
+	info := &FileInfo{name: name, modTime: m.when, hash: entry.Hash}
+	switch entry.Mode {
+	case filemode.Dir:
+		info.mode = os.ModeDir | 0555
+	case filemode.Regular, filemode.Deprecated:
+		info.mode = 0444
+	case filemode.Executable:
+		info.mode = 0555
+	default: // submodules, links are resolved by callers
+		return nil, fs.ErrNotExist
+	}
+	if !info.IsDir() {
+		size, err := m.repo.Storer.EncodedObjectSize(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		info.size = size
+	}
+	return info, nil
+}
+
+func (m *snapshot) blob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := m.repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (m *GitFs) Stat(name string) (os.FileInfo, error) {
+	_, _, info, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (m *GitFs) Open(name string) (afero.File, error) {
+	snap, resolved, info, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info.IsDir() {
+		tree, err := snap.repo.TreeObject(info.hash)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		dir := make([]os.FileInfo, 0, len(tree.Entries))
+		for i := range tree.Entries {
+			entry := &tree.Entries[i]
+			entryInfo, err := snap.info(entry.Name, entry)
+			if entry.Mode == filemode.Symlink {
+				// listed as what they point to
+				_, entryInfo, err = snap.resolve(path.Join(resolved, entry.Name))
+				if err == nil {
+					target := *entryInfo
+					target.name = entry.Name
+					entryInfo = &target
+				}
+			}
+			if err != nil {
+				continue // submodules and broken links
+			}
+			dir = append(dir, entryInfo)
+		}
+		return &File{name: name, info: info, dir: dir}, nil
+	}
+	data, err := snap.blob(info.hash)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &File{name: name, info: info, r: bytes.NewReader(data)}, nil
+}
+
+func (m *GitFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	return m.Open(name)
+}
+
+func (m *GitFs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) Rename(oldname, newname string) error {
+	return &os.PathError{Op: "rename", Path: oldname, Err: syscall.EPERM}
+}
+
+func (m *GitFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+func (m *GitFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+func (m *File) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	return nil
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	if m.r == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.r.Read(p)
+}
+
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if m.r == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.r.ReadAt(p, off)
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	if m.r == nil {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.r.Seek(offset, whence)
+}
+
+func (m *File) Stat() (os.FileInfo, error) {
+	return m.info, nil
+}
+
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	if m.r != nil {
+		return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+	}
+	rest := m.dir[m.dirAt:]
+	if count <= 0 {
+		m.dirAt = len(m.dir)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	m.dirAt += len(rest)
+	return rest, nil
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *FileInfo) Name() string {
+	return m.name
+}
+
+func (m *FileInfo) Size() int64 {
+	return m.size
+}
+
+func (m *FileInfo) Mode() os.FileMode {
+	return m.mode
+}
+
+func (m *FileInfo) ModTime() time.Time {
+	return m.modTime
+}
+
+func (m *FileInfo) IsDir() bool {
+	return m.mode.IsDir()
+}
+
+func (m *FileInfo) Sys() any {
+	return nil
+}
+
+// ETag is the hash of the blob or tree
+func (m *FileInfo) ETag() string {
+	return m.hash.String()
+}
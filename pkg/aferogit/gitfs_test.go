@@ -0,0 +1,215 @@
+package aferogit
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// repoForTest creates repository with branch main at dir
+func repoForTest(t *testing.T, dir string) *git.Repository {
+	repo, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	assert.NoError(t, err)
+	return repo
+}
+
+// commitForTest writes files, symlinks for values starting with "->", and commits them
+func commitForTest(t *testing.T, repo *git.Repository, files map[string]string) plumbing.Hash {
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	for name, data := range files {
+		full := filepath.Join(wt.Filesystem.Root(), name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(full), 0755))
+		if len(data) > 2 && data[:2] == "->" {
+			assert.NoError(t, os.Symlink(data[2:], full))
+		} else {
+			assert.NoError(t, os.WriteFile(full, []byte(data), 0644))
+		}
+		_, err := wt.Add(name)
+		assert.NoError(t, err)
+	}
+	hash, err := wt.Commit("update", &git.CommitOptions{Author: &object.Signature{Name: "ztp", Email: "ztp@example.com", When: time.Now()}})
+	assert.NoError(t, err)
+	return hash
+}
+
+func TestGitFs(t *testing.T) {
+	dir := t.TempDir()
+	repo := repoForTest(t, dir)
+	first := commitForTest(t, repo, map[string]string{
+		"configs/sw1.cfg":     "hostname sw1",
+		"configs/sw2.cfg":     "hostname sw2",
+		"configs/sw3.cfg":     "hostname sw3",
+		"configs/default.cfg": "->sw1.cfg",
+		"ztp.sh":              "#!/bin/sh",
+	})
+	_, err := repo.CreateTag("v1", first, nil)
+	assert.NoError(t, err)
+
+	gitfs := NewLocalGitFs(dir, "main", 0)
+	got, err := afero.ReadFile(gitfs, "/configs/sw2.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname sw2", string(got))
+	got, err = afero.ReadFile(gitfs, "/configs/default.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname sw1", string(got))
+	info, err := gitfs.Stat("/configs/default.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "default.cfg", info.Name())
+	assert.Equal(t, int64(len("hostname sw1")), info.Size())
+	info, err = gitfs.Stat("/configs")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	_, err = gitfs.Stat("/configs/missing.cfg")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// listing by pages
+	f, err := gitfs.Open("/configs")
+	assert.NoError(t, err)
+	var names []string
+	for {
+		page, err := f.Readdirnames(3)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, page...)
+	}
+	assert.Equal(t, []string{"default.cfg", "sw1.cfg", "sw2.cfg", "sw3.cfg"}, names)
+
+	f, err = gitfs.Open("/ztp.sh")
+	assert.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = f.ReadAt(buf, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, "sh", string(buf))
+	_, err = gitfs.OpenFile("/ztp.sh", os.O_RDWR, 0644)
+	assert.ErrorIs(t, err, syscall.EPERM)
+	assert.ErrorIs(t, gitfs.Remove("/ztp.sh"), syscall.EPERM)
+
+	// without poll the commit stays
+	commitForTest(t, repo, map[string]string{"configs/sw2.cfg": "hostname sw2-new"})
+	got, err = afero.ReadFile(gitfs, "/configs/sw2.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname sw2", string(got))
+
+	// tags and commits stay put while branches move on poll
+	polled := NewLocalGitFs(dir, "main", time.Millisecond)
+	tagged := NewLocalGitFs(dir, "v1", time.Millisecond)
+	pinned := NewLocalGitFs(dir, first.String()[:12], time.Millisecond)
+	for _, tt := range []struct {
+		fs       afero.Fs
+		expected string
+	}{{polled, "hostname sw2-new"}, {tagged, "hostname sw2"}, {pinned, "hostname sw2"}} {
+		got, err = afero.ReadFile(tt.fs, "/configs/sw2.cfg")
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, string(got))
+	}
+	commitForTest(t, repo, map[string]string{"configs/sw2.cfg": "hostname sw2-newer"})
+	// reads keep the tree until the check in the background switches it
+	assert.Eventually(t, func() bool {
+		got, err := afero.ReadFile(polled, "/configs/sw2.cfg")
+		return err == nil && string(got) == "hostname sw2-newer"
+	}, 5*time.Second, time.Millisecond)
+	got, err = afero.ReadFile(tagged, "/configs/sw2.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname sw2", string(got))
+
+	_, err = NewLocalGitFs(dir, "missing", 0).Stat("/")
+	assert.Error(t, err)
+}
+
+func TestRemoteGitFs(t *testing.T) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git http-backend is not available")
+	}
+	root := t.TempDir()
+	repo := repoForTest(t, filepath.Join(root, "configs"))
+	commitForTest(t, repo, map[string]string{"sw1.cfg": "hostname sw0"})
+	first := commitForTest(t, repo, map[string]string{"sw1.cfg": "hostname sw1"})
+	_, err = repo.CreateTag("v1", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "ztp", Email: "ztp@example.com", When: time.Now()},
+		Message: "v1",
+	})
+	assert.NoError(t, err)
+	server := httptest.NewServer(&cgi.Handler{
+		Path: gitBin,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	defer server.Close()
+
+	gitfs := NewRemoteGitFs(server.URL+"/configs/.git", nil, "main", time.Millisecond)
+	got, err := afero.ReadFile(gitfs, "/sw1.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname sw1", string(got))
+	// history is not fetched
+	assert.Equal(t, 1, commitsForTest(t, gitfs))
+
+	// objects of commits replaced are not kept
+	objects := objectsForTest(t, gitfs)
+	for i := 0; i < 3; i++ {
+		hostname := fmt.Sprintf("hostname sw1-%d", i)
+		commitForTest(t, repo, map[string]string{"sw1.cfg": hostname})
+		assert.Eventually(t, func() bool {
+			got, err := afero.ReadFile(gitfs, "/sw1.cfg")
+			return err == nil && string(got) == hostname
+		}, 5*time.Second, time.Millisecond)
+		assert.Equal(t, 1, commitsForTest(t, gitfs))
+		assert.Equal(t, objects, objectsForTest(t, gitfs))
+	}
+
+	for _, ref := range []string{"v1", first.String()} {
+		got, err = afero.ReadFile(NewRemoteGitFs(server.URL+"/configs/.git", nil, ref, 0), "/sw1.cfg")
+		assert.NoError(t, err, ref)
+		assert.Equal(t, "hostname sw1", string(got), ref)
+	}
+	_, err = NewRemoteGitFs(server.URL+"/configs/.git", nil, "missing", 0).Stat("/")
+	assert.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+
+	// unreachable remote keeps serving the commit loaded before
+	server.Close()
+	time.Sleep(2 * time.Millisecond)
+	got, err = afero.ReadFile(gitfs, "/sw1.cfg")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname sw1-2", string(got))
+}
+
+// commitsForTest counts commits stored by the fs
+func commitsForTest(t *testing.T, gitfs *GitFs) int {
+	snap, err := gitfs.snapshot()
+	assert.NoError(t, err)
+	iter, err := snap.repo.CommitObjects()
+	assert.NoError(t, err)
+	n := 0
+	assert.NoError(t, iter.ForEach(func(*object.Commit) error { n++; return nil }))
+	return n
+}
+
+// objectsForTest counts objects stored by the fs
+func objectsForTest(t *testing.T, gitfs *GitFs) int {
+	snap, err := gitfs.snapshot()
+	assert.NoError(t, err)
+	iter, err := snap.repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	assert.NoError(t, err)
+	n := 0
+	assert.NoError(t, iter.ForEach(func(plumbing.EncodedObject) error { n++; return nil }))
+	return n
+}
@@ -0,0 +1,451 @@
+package aferohttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// HttpFs is a read-only afero.Fs of files served by an http server under base url
+// files are read with range requests, so they can be seeked and read at offsets
+// and dirs are listed by parsing autoindex pages
+type HttpFs struct {
+	base   *url.URL
+	client *http.Client
+}
+
+// FileInfo describes a file from response headers
+type FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	etag    string
+	dir     bool
+}
+
+// File reads a remote file streaming sequential reads over one response
+type File struct {
+	fs     *HttpFs
+	name   string
+	info   *FileInfo
+	offset int64
+	body   io.ReadCloser // response streaming from bodyAt, nil if none
+	bodyAt int64
+	dir    []*FileInfo // entries of dir listing, nil until read
+	dirAt  int
+}
+
+func NewHttpFs(base *url.URL, client *http.Client) *HttpFs {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HttpFs{base: base, client: client}
+}
+
+func (m *HttpFs) Name() string {
+	return "HttpFs"
+}
+
+// url returns the url of name under base url
+func (m *HttpFs) url(name string) *url.URL {
+	u := *m.base
+	u.Path = path.Join("/", m.base.Path, filepath.ToSlash(name))
+	u.RawPath = ""
+	return &u
+}
+
+func (m *HttpFs) Stat(name string) (os.FileInfo, error) {
+	return m.stat(name)
+}
+
+func (m *HttpFs) stat(name string) (*FileInfo, error) {
+	name = filepath.Join("/", name)
+	if name == "/" {
+		return &FileInfo{name: "/", dir: true}, nil
+	}
+	req, err := http.NewRequest(http.MethodHead, m.url(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: statusError(resp)}
+	}
+	info := fileInfo(name, resp)
+	// servers redirect dirs to the path with trailing slash
+	if strings.HasSuffix(resp.Request.URL.Path, "/") {
+		info.dir, info.size = true, 0
+	}
+	if info.size < 0 {
+		info.size = m.probeSize(name)
+	}
+	return info, nil
+}
+
+// probeSize requests the first byte to learn the size from Content-Range
+// for servers answering HEAD without Content-Length, -1 if still unknown
+func (m *HttpFs) probeSize(name string) int64 {
+	req, err := http.NewRequest(http.MethodGet, m.url(name).String(), nil)
+	if err != nil {
+		return -1
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// ranges are ignored for some files such as empty ones
+		return resp.ContentLength
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+			return size
+		}
+	}
+	return -1
+}
+
+func (m *HttpFs) Open(name string) (afero.File, error) {
+	info, err := m.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{fs: m, name: name, info: info}, nil
+}
+
+func (m *HttpFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	return m.Open(name)
+}
+
+func (m *HttpFs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+func (m *HttpFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+// get requests the file from offset up to end, end < 0 reads to the end of file
+// servers ignoring ranges are read from the start and skipped to offset
+func (m *HttpFs) get(name string, info *FileInfo, offset, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, m.url(name).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 || end >= 0 {
+		rng := fmt.Sprintf("bytes=%d-", offset)
+		if end >= 0 {
+			rng += strconv.FormatInt(end, 10)
+		}
+		req.Header.Set("Range", rng)
+		// changed file is returned whole instead of the range
+		if info.etag != "" && !strings.HasPrefix(info.etag, "W/") {
+			req.Header.Set("If-Range", info.etag)
+		} else if !info.modTime.IsZero() {
+			req.Header.Set("If-Range", info.modTime.UTC().Format(http.TimeFormat))
+		}
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		if changed(info, resp) {
+			resp.Body.Close()
+			return nil, &os.PathError{Op: "read", Path: name, Err: errors.New("file changed while reading")}
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, &os.PathError{Op: "read", Path: name, Err: err}
+		}
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	default:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "read", Path: name, Err: statusError(resp)}
+	}
+}
+
+// changed reports whether the response is of another version of the file
+func changed(info *FileInfo, resp *http.Response) bool {
+	if etag := resp.Header.Get("ETag"); etag != "" && info.etag != "" {
+		return etag != info.etag
+	}
+	return resp.ContentLength >= 0 && info.size >= 0 && resp.ContentLength != info.size
+}
+
+// StatusError is an unexpected response of the server, it matches
+// fs.ErrNotExist for 404 and 410 and fs.ErrPermission for 401 and 403
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func statusError(resp *http.Response) error {
+	return &StatusError{
+		URL:        resp.Request.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+}
+
+func (m *StatusError) Error() string {
+	return fmt.Sprintf("%s %s", m.URL, m.Status)
+}
+
+func (m *StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return m.StatusCode == http.StatusNotFound || m.StatusCode == http.StatusGone
+	case fs.ErrPermission:
+		return m.StatusCode == http.StatusUnauthorized || m.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+func fileInfo(name string, resp *http.Response) *FileInfo {
+	info := &FileInfo{
+		name: filepath.Base(name),
+		size: resp.ContentLength,
+		etag: resp.Header.Get("ETag"),
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.modTime = modTime
+	}
+	return info
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+func (m *File) Stat() (os.FileInfo, error) {
+	return m.info, nil
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	if m.info.dir {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if m.info.size >= 0 && m.offset >= m.info.size {
+		return 0, io.EOF
+	}
+	if m.body == nil || m.bodyAt != m.offset {
+		m.closeBody()
+		body, err := m.fs.get(m.name, m.info, m.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		m.body, m.bodyAt = body, m.offset
+	}
+	n, err := m.body.Read(p)
+	m.offset += int64(n)
+	m.bodyAt += int64(n)
+	if err == io.EOF {
+		m.closeBody()
+		if m.info.size >= 0 && m.offset < m.info.size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if m.info.dir {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if m.info.size >= 0 && off >= m.info.size {
+		return 0, io.EOF
+	}
+	body, err := m.fs.get(m.name, m.info, off, off+int64(len(p))-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		if m.info.size < 0 {
+			return 0, &os.PathError{Op: "seek", Path: m.name, Err: errors.New("unknown size")}
+		}
+		offset += m.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EINVAL}
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *File) Close() error {
+	m.closeBody()
+	return nil
+}
+
+func (m *File) closeBody() {
+	if m.body != nil {
+		m.body.Close()
+		m.body = nil
+	}
+}
+
+// Readdir lists entries parsed from the autoindex page of the dir
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !m.info.dir {
+		return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+	}
+	if m.dir == nil {
+		dir, err := m.fs.readdir(m.name)
+		if err != nil {
+			return nil, err
+		}
+		m.dir = dir
+	}
+	rest := m.dir[m.dirAt:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(count, len(rest))]
+	}
+	m.dirAt += len(rest)
+	infos := make([]os.FileInfo, len(rest))
+	for i, info := range rest {
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EPERM}
+}
+
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EPERM}
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return m.Write([]byte(s))
+}
+
+func (m *File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EPERM}
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *FileInfo) Name() string {
+	return m.name
+}
+
+// Size is -1 if the server did not report it for the file
+// and 0 for listing entries without exact size
+func (m *FileInfo) Size() int64 {
+	return m.size
+}
+
+func (m *FileInfo) Mode() os.FileMode {
+	if m.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (m *FileInfo) ModTime() time.Time {
+	return m.modTime
+}
+
+func (m *FileInfo) IsDir() bool {
+	return m.dir
+}
+
+func (m *FileInfo) Sys() any {
+	return nil
+}
+
+// ETag is the entity tag of the file if the server reported it
+func (m *FileInfo) ETag() string {
+	return m.etag
+}
@@ -0,0 +1,258 @@
+package aferohttp
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	contents := strings.Repeat("0123456789", 1000)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "a"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a", "file.bin"), []byte(contents), 0644))
+	fs, ranges := httpFsForTest(t, http.FileServer(http.Dir(dir)))
+
+	info, err := fs.Stat("/a/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "file.bin", info.Name())
+	assert.Equal(t, int64(len(contents)), info.Size())
+	assert.False(t, info.IsDir())
+	assert.False(t, info.ModTime().IsZero())
+
+	info, err = fs.Stat("/a")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	file, err := fs.Open("/a/file.bin")
+	assert.NoError(t, err)
+	defer file.Close()
+	all, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, string(all))
+
+	pos, err := file.Seek(-5, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)-5), pos)
+	rest, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "56789", string(rest))
+
+	buf := make([]byte, 4)
+	n, err := file.ReadAt(buf, 13)
+	assert.NoError(t, err)
+	assert.Equal(t, "3456", string(buf[:n]))
+	n, err = file.ReadAt(buf, int64(len(contents)-2))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "89", string(buf[:n]))
+
+	assert.Equal(t, []string{"", "bytes=9995-", "bytes=13-16", "bytes=9998-10001"}, ranges())
+}
+
+func TestNoRangeSupport(t *testing.T) {
+	contents := "file contents"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "13")
+		io.WriteString(w, contents)
+	})
+	fs, _ := httpFsForTest(t, handler)
+	file, err := fs.Open("/file.txt")
+	assert.NoError(t, err)
+	defer file.Close()
+	_, err = file.Seek(5, io.SeekStart)
+	assert.NoError(t, err)
+	rest, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "contents", string(rest))
+}
+
+func TestUnknownSize(t *testing.T) {
+	contents := "file contents"
+	ranges := true
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			// chunked responses have no length
+			w.WriteHeader(http.StatusOK)
+		case ranges && r.URL.Path == "/empty.txt":
+			http.ServeContent(w, r, "empty.txt", time.Time{}, strings.NewReader(""))
+		case ranges:
+			http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(contents))
+		default:
+			w.(http.Flusher).Flush()
+			io.WriteString(w, contents)
+		}
+	})
+	fs, _ := httpFsForTest(t, handler)
+	info, err := fs.Stat("/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(contents)), info.Size())
+	info, err = fs.Stat("/empty.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	ranges = false
+	info, err = fs.Stat("/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), info.Size())
+	got, err := afero.ReadFile(fs, "/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, contents, string(got))
+}
+
+const nginxListing = `<html>
+<head><title>Index of /images/</title></head>
+<body>
+<h1>Index of /images/</h1><hr><pre><a href="../">../</a>
+<a href="sub/">sub/</a>                                               17-Oct-2026 07:00                   -
+<a href="file%20one.bin">file one.bin</a>                                      17-Oct-2026 07:01                1234
+</pre><hr></body>
+</html>
+`
+
+const apacheListing = `<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+ <head>
+  <title>Index of /images</title>
+ </head>
+ <body>
+<h1>Index of /images</h1>
+  <table>
+   <tr><th valign="top"><img src="/icons/blank.gif" alt="[ICO]"></th><th><a href="?C=N;O=D">Name</a></th><th><a href="?C=M;O=A">Last modified</a></th><th><a href="?C=S;O=A">Size</a></th><th><a href="?C=D;O=A">Description</a></th></tr>
+   <tr><th colspan="5"><hr></th></tr>
+<tr><td valign="top"><img src="/icons/back.gif" alt="[PARENTDIR]"></td><td><a href="/">Parent Directory</a></td><td>&nbsp;</td><td align="right">  - </td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/folder.gif" alt="[DIR]"></td><td><a href="sub/">sub/</a></td><td align="right">2026-10-17 07:00  </td><td align="right">  - </td><td>&nbsp;</td></tr>
+<tr><td valign="top"><a href="file%20one.bin"><img src="/icons/unknown.gif" alt="[   ]"></a></td><td><a href="file%20one.bin">file one.bin</a></td><td align="right">2026-10-17 07:01  </td><td align="right">1234</td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/unknown.gif" alt="[   ]"></td><td><a href="big.bin">big.bin</a></td><td align="right">2026-10-17 07:02  </td><td align="right">1.2M</td><td>&nbsp;</td></tr>
+   <tr><th colspan="5"><hr></th></tr>
+</table>
+</body></html>
+`
+
+const jsonListing = `[
+{ "name":"sub", "type":"directory", "mtime":"Sat, 17 Oct 2026 07:00:00 GMT" },
+{ "name":"file one.bin", "type":"file", "mtime":"Sat, 17 Oct 2026 07:01:00 GMT", "size":1234 }
+]
+`
+
+func TestReaddir(t *testing.T) {
+	at := func(minute int) time.Time {
+		return time.Date(2026, 10, 17, 7, minute, 0, 0, time.UTC)
+	}
+	type entry struct {
+		Name    string
+		Dir     bool
+		Size    int64
+		ModTime time.Time
+	}
+	tests := []struct {
+		name    string
+		listing string
+		want    []entry
+	}{
+		{"nginx", nginxListing, []entry{
+			{"sub", true, 0, at(0)},
+			{"file one.bin", false, 1234, at(1)},
+		}},
+		{"apache", apacheListing, []entry{
+			{"sub", true, 0, at(0)},
+			{"file one.bin", false, 1234, at(1)},
+			{"big.bin", false, 0, at(2)},
+		}},
+		{"nginx json", jsonListing, []entry{
+			{"sub", true, 0, at(0)},
+			{"file one.bin", false, 1234, at(1)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.Handle("/images", http.RedirectHandler("/images/", http.StatusMovedPermanently))
+			mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, tt.listing)
+			})
+			afs, _ := httpFsForTest(t, mux)
+			infos, err := afero.ReadDir(afs, "/images")
+			assert.NoError(t, err)
+			got := make([]entry, 0, len(infos))
+			for _, info := range infos {
+				got = append(got, entry{info.Name(), info.IsDir(), info.Size(), info.ModTime().UTC()})
+			}
+			assert.ElementsMatch(t, tt.want, got)
+		})
+	}
+
+	t.Run("file server", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "sub"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "a", "file one.bin"), []byte("contents"), 0644))
+		afs, _ := httpFsForTest(t, http.FileServer(http.Dir(dir)))
+		names, err := afero.ReadDir(afs, "/a")
+		assert.NoError(t, err)
+		if assert.Len(t, names, 2) {
+			assert.Equal(t, "file one.bin", names[0].Name())
+			assert.False(t, names[0].IsDir())
+			assert.Equal(t, "sub", names[1].Name())
+			assert.True(t, names[1].IsDir())
+		}
+		file, err := afs.Open("/a/file one.bin")
+		assert.NoError(t, err)
+		defer file.Close()
+		_, err = file.Readdir(-1)
+		assert.ErrorIs(t, err, syscall.ENOTDIR)
+	})
+}
+
+func TestStatusError(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(code)
+	})
+	afs, _ := httpFsForTest(t, handler)
+	for code, target := range map[int]error{404: fs.ErrNotExist, 410: fs.ErrNotExist, 401: fs.ErrPermission, 403: fs.ErrPermission} {
+		_, err := afs.Stat(strconv.Itoa(code))
+		assert.ErrorIs(t, err, target, code)
+	}
+	_, err := afs.Stat("/500")
+	var serr *StatusError
+	assert.ErrorAs(t, err, &serr)
+	assert.Equal(t, 500, serr.StatusCode)
+	assert.NotErrorIs(t, err, fs.ErrNotExist)
+	assert.NotErrorIs(t, err, fs.ErrPermission)
+}
+
+// httpFsForTest serves handler returning HttpFs of it
+// and the list of range headers of GET requests
+func httpFsForTest(t *testing.T, handler http.Handler) (*HttpFs, func() []string) {
+	mu := sync.Mutex{}
+	ranges := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	base, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	return NewHttpFs(base, server.Client()), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return ranges
+	}
+}
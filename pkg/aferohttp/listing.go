@@ -0,0 +1,214 @@
+package aferohttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// maxListingSize limits the autoindex page read to list a dir
+const maxListingSize = 32 << 20
+
+// listing time formats of nginx and apache autoindex pages
+var listingTimes = []struct {
+	re     *regexp.Regexp
+	layout string
+}{
+	{regexp.MustCompile(`\d{2}-[A-Z][a-z]{2}-\d{4} \d{2}:\d{2}(:\d{2})?`), "02-Jan-2006 15:04"},
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2} \d{2}:\d{2}(:\d{2})?`), "2006-01-02 15:04"},
+}
+
+// jsonEntry is an entry of nginx autoindex_format json
+type jsonEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	MTime string `json:"mtime"`
+	Size  *int64 `json:"size"`
+}
+
+// readdir fetches the autoindex page of dir and parses its entries
+func (m *HttpFs) readdir(name string) ([]*FileInfo, error) {
+	u := m.url(name)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: statusError(resp)}
+	}
+	infos, err := parseListing(io.LimitReader(resp.Body, maxListingSize), resp.Request.URL)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return infos, nil
+}
+
+// parseListing parses nginx json or html autoindex page of dir url,
+// html pages are nginx, apache or go http.FileServer listings.
+// Entries without exact size are reported as 0 as listings print sizes,
+// Stat of the file asks the server for it
+func parseListing(r io.Reader, dir *url.URL) ([]*FileInfo, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("empty listing: %w", err)
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			if b[0] == '[' {
+				return parseJSONListing(br)
+			}
+			return parseHTMLListing(br, dir)
+		}
+		br.ReadByte()
+	}
+}
+
+func parseJSONListing(r io.Reader) ([]*FileInfo, error) {
+	entries := make([]jsonEntry, 0)
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("json listing: %w", err)
+	}
+	infos := make([]*FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !validName(entry.Name) {
+			continue
+		}
+		info := &FileInfo{name: entry.Name, dir: entry.Type == "directory"}
+		if entry.Size != nil && !info.dir {
+			info.size = *entry.Size
+		}
+		if modTime, err := http.ParseTime(entry.MTime); err == nil {
+			info.modTime = modTime
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// parseHTMLListing takes links to direct children of dir as entries,
+// modification time and size are parsed from the text following the link
+func parseHTMLListing(r io.Reader, dir *url.URL) ([]*FileInfo, error) {
+	infos := make([]*FileInfo, 0)
+	seen := make(map[string]*FileInfo)
+	var last *FileInfo
+	var text []string
+	flush := func() {
+		if last != nil {
+			parseListingText(last, strings.Join(text, " "))
+		}
+		last, text = nil, nil
+	}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return nil, fmt.Errorf("html listing: %w", z.Err())
+			}
+			flush()
+			return infos, nil
+		case html.StartTagToken:
+			tag, hasAttr := z.TagName()
+			switch string(tag) {
+			case "a":
+				flush()
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) != "href" {
+						continue
+					}
+					info := listingEntry(dir, string(val))
+					if info == nil {
+						continue
+					}
+					// same entry is often linked by its icon too
+					if prev, ok := seen[info.name]; ok {
+						info = prev
+					} else {
+						seen[info.name] = info
+						infos = append(infos, info)
+					}
+					last = info
+				}
+			case "tr":
+				flush()
+			}
+		case html.TextToken:
+			if last != nil {
+				text = append(text, string(z.Text()))
+			}
+		}
+	}
+}
+
+// listingEntry returns entry linked by href if it is a child of dir
+func listingEntry(dir *url.URL, href string) *FileInfo {
+	u, err := dir.Parse(href)
+	if err != nil || u.Host != dir.Host || u.RawQuery != "" {
+		return nil
+	}
+	parent := strings.TrimSuffix(dir.Path, "/") + "/"
+	rel, ok := strings.CutPrefix(u.Path, parent)
+	if !ok {
+		return nil
+	}
+	isDir := strings.HasSuffix(rel, "/")
+	rel = strings.TrimSuffix(rel, "/")
+	if !validName(rel) {
+		return nil
+	}
+	return &FileInfo{name: rel, dir: isDir}
+}
+
+// parseListingText fills modification time and exact size from the text
+// of an autoindex line, humanized sizes like 1.2K are left 0
+func parseListingText(info *FileInfo, text string) {
+	text = strings.ReplaceAll(text, "\u00a0", " ") // &nbsp;
+	for _, lt := range listingTimes {
+		loc := lt.re.FindStringIndex(text)
+		if loc == nil {
+			continue
+		}
+		layout := lt.layout
+		if loc[1]-loc[0] > len(layout) {
+			layout += ":05"
+		}
+		if modTime, err := time.Parse(layout, text[loc[0]:loc[1]]); err == nil {
+			info.modTime = modTime
+		}
+		text = text[loc[1]:]
+		break
+	}
+	fields := strings.Fields(text)
+	if info.dir || len(fields) == 0 {
+		return
+	}
+	if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil && size >= 0 {
+		info.size = size
+	}
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/") && path.Clean(name) == name
+}
@@ -2,27 +2,73 @@ package aferomount
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/afero"
 )
 
 // MountFs is a convenience afero.Fs to map prefix to another prefixs
+// fs mounted at the same path are stacked as a union: reads fall through
+// the layers top-down while the file is missing, writes go to the top layer
+// It is safe to Mount and Umount while the fs is in use
 type MountFs struct {
-	base       afero.Fs              // base fs if no mountpoint found
-	mounts     map[string][]afero.Fs // map from path to mount
-	paths      []string              // reverse sorted by lenght
-	pathIndex  map[string]int        // reverse indexes of paths
-	dirCreated map[string]struct{}   // marks that we created a dir at mount
+	*mountTable
+	protocol string // view of the mount table, empty sees all the mounts
+}
+
+// mountTable is shared between MountFs views for different protocols
+type mountTable struct {
+	mu         sync.RWMutex        // guards mount table below
+	base       afero.Fs            // base fs if no mountpoint found
+	mounts     map[string][]*mount // map from path to mount
+	paths      []string            // reverse sorted by lenght
+	dirCreated map[string]struct{} // marks that we created a dir at mount
+}
+
+// MountOptions tune how a mounted fs is exposed
+type MountOptions struct {
+	ReadOnly    bool     // deny any modifications
+	Hidden      bool     // mountpoint is omitted from parent dir listing
+	Priority    int      // layers with higher priority are stacked above
+	Protocols   []string // protocols the mount is visible to, empty is all
+	Description string   // backend description for the mount table
+}
+
+type mount struct {
+	afero.Fs
+	src  afero.Fs // fs as it was passed to Mount
+	opts MountOptions
+}
+
+// MountEntry is a single layer in a mount table
+type MountEntry struct {
+	Path    string       // mountpoint
+	Layer   int          // position in the stack at mountpoint, 0 is the bottom
+	Backend string       // description of the mounted fs
+	Options MountOptions // options the fs was mounted with
 }
 
 // MountFile represents a file inside a mountfs with original name intact
 type MountFile struct {
 	afero.File
+	name    string
+	fs      *MountFs
+	entries []os.FileInfo // merged directory listing
+	offset  int           // position in entries for subsequent Readdir calls
+}
+
+// mountInfo is a synthetic dir entry for a mountpoint
+type mountInfo struct {
+	os.FileInfo
 	name string
 }
 
@@ -30,11 +76,12 @@ type MountFile struct {
 // of a path when calling the underlying FS implementation.
 func NewMountFS(base afero.Fs) *MountFs {
 	return &MountFs{
-		base:       base,
-		mounts:     make(map[string][]afero.Fs),
-		paths:      make([]string, 0),
-		pathIndex:  make(map[string]int),
-		dirCreated: make(map[string]struct{}),
+		mountTable: &mountTable{
+			base:       base,
+			mounts:     make(map[string][]*mount),
+			paths:      make([]string, 0),
+			dirCreated: make(map[string]struct{}),
+		},
 	}
 }
 
@@ -42,9 +89,21 @@ func (m *MountFs) Name() string {
 	return "MountFs"
 }
 
+// ForProtocol returns a view of the fs with only mounts visible to protocol
+// the view shares the mount table with m
+func (m *MountFs) ForProtocol(protocol string) afero.Fs {
+	return &MountFs{mountTable: m.mountTable, protocol: protocol}
+}
+
 func (m *MountFs) Mount(mountfs afero.Fs, path string) error {
+	return m.MountWithOptions(mountfs, path, MountOptions{})
+}
+
+func (m *MountFs) MountWithOptions(mountfs afero.Fs, path string, opts MountOptions) error {
 	apath := absPath(path)
-	afs := afero.Afero{m.base}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	afs := afero.Afero{Fs: m.base}
 	dirExist, err := afs.DirExists(apath)
 	if err != nil {
 		return err
@@ -57,34 +116,64 @@ func (m *MountFs) Mount(mountfs afero.Fs, path string) error {
 	}
 	mounts, ok := m.mounts[apath]
 	if !ok {
-		mounts = make([]afero.Fs, 0, 1)
-		paths, idx := insertSorted(m.paths, apath, byReverseLen)
-		m.paths = paths
-		m.pathIndex[apath] = idx
+		mounts = make([]*mount, 0, 1)
+		m.paths, _ = insertSorted(m.paths, apath, byReverseLen)
+	}
+	src := mountfs
+	if opts.ReadOnly {
+		mountfs = afero.NewReadOnlyFs(mountfs)
 	}
-	mounts = append(mounts, mountfs)
+	// keep stack ordered by priority, newer goes on top of the same priority
+	idx := sort.Search(len(mounts), func(i int) bool {
+		return mounts[i].opts.Priority > opts.Priority
+	})
+	mounts = append(mounts, nil)
+	copy(mounts[idx+1:], mounts[idx:])
+	mounts[idx] = &mount{Fs: mountfs, src: src, opts: opts}
 	m.mounts[apath] = mounts
 	return nil
 }
 
+// Umount removes the top layer mounted at path
 func (m *MountFs) Umount(path string) error {
 	apath := absPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	mounts, ok := m.mounts[apath]
-	if !ok {
+	if !ok || len(mounts) == 0 {
 		return errors.New("not mounted")
 	}
-	if len(mounts) > 0 {
-		mounts = mounts[:len(mounts)-1]
-		m.mounts[apath] = mounts
+	return m.umountLocked(apath, len(mounts)-1)
+}
+
+// UmountFs removes the layer with mountfs at path wherever it is in the stack
+// files opened before continue to be served by mountfs
+func (m *MountFs) UmountFs(mountfs afero.Fs, path string) error {
+	apath := absPath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, mount := range m.mounts[apath] {
+		if mount.src == mountfs {
+			return m.umountLocked(apath, i)
+		}
 	}
+	return errors.New("not mounted")
+}
+
+func (m *MountFs) umountLocked(apath string, idx int) error {
+	mounts := slices.Delete(slices.Clone(m.mounts[apath]), idx, idx+1)
 	if len(mounts) > 0 {
+		m.mounts[apath] = mounts
 		return nil
 	}
 	delete(m.mounts, apath)
-	idx := m.pathIndex[apath]
-	delete(m.pathIndex, apath)
-	copy(m.paths[idx:], m.paths[idx+1:])
-	m.paths = m.paths[:len(m.paths)-1]
+	paths := make([]string, 0, len(m.paths))
+	for _, mpath := range m.paths {
+		if mpath != apath {
+			paths = append(paths, mpath)
+		}
+	}
+	m.paths = paths
 	if _, ok := m.dirCreated[apath]; ok {
 		delete(m.dirCreated, apath)
 		if err := m.base.Remove(apath); err != nil {
@@ -94,17 +183,157 @@ func (m *MountFs) Umount(path string) error {
 	return nil
 }
 
+// Mounts returns the mount table ordered by path and layer
+func (m *MountFs) Mounts() []MountEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make([]MountEntry, 0, len(m.mounts))
+	for mpath, mounts := range m.mounts {
+		for i, mount := range mounts {
+			entries = append(entries, MountEntry{
+				Path:    mpath,
+				Layer:   i,
+				Backend: mount.describe(),
+				Options: mount.opts,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Path != entries[j].Path {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Layer < entries[j].Layer
+	})
+	return entries
+}
+
+// describe prefers explicit description, then fmt.Stringer and falls back to fs name
+func (m *mount) describe() string {
+	if m.opts.Description != "" {
+		return m.opts.Description
+	}
+	if stringer, ok := m.Fs.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return m.Fs.Name()
+}
+
+// visibleMounts returns mounts at path visible to the view protocol
+func (m *MountFs) visibleMounts(path string) []*mount {
+	mounts := m.mounts[path]
+	if m.protocol == "" {
+		return mounts
+	}
+	visible := make([]*mount, 0, len(mounts))
+	for _, mount := range mounts {
+		if len(mount.opts.Protocols) == 0 || slices.Contains(mount.opts.Protocols, m.protocol) {
+			visible = append(visible, mount)
+		}
+	}
+	return visible
+}
+
+// layer is an fs in a mount stack with the name resolved relative to it
+type layer struct {
+	afero.Fs
+	name string
+	base bool
+}
+
+// findLayers returns the stack of fs mounted at the longest matching mountpoint
+// topmost layer first, base is added last for parents of nested mountpoints
+// so dirs created in base by Mount are reachable from under a mount
+func (m *MountFs) findLayers(name string) []layer {
+	aname := absPath(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	layers := make([]layer, 0)
+	for _, mpath := range m.paths {
+		mounts := m.visibleMounts(mpath)
+		if len(mounts) > 0 && hasPathPrefix(aname, mpath) {
+			mname := absPath(strings.TrimPrefix(aname, mpath))
+			for i := len(mounts) - 1; i >= 0; i-- {
+				layers = append(layers, layer{Fs: mounts[i].Fs, name: mname})
+			}
+			break
+		}
+	}
+	if len(layers) == 0 || len(m.childMountsLocked(aname, true)) > 0 {
+		layers = append(layers, layer{Fs: m.base, name: aname, base: true})
+	}
+	return layers
+}
+
+// Lookup returns fs stacked at the mountpoint of name as they were passed to Mount
+// topmost first, nil if name is outside of mounts visible to the view
+func (m *MountFs) Lookup(name string) []afero.Fs {
+	aname := absPath(name)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, mpath := range m.paths {
+		mounts := m.visibleMounts(mpath)
+		if len(mounts) > 0 && hasPathPrefix(aname, mpath) {
+			stack := make([]afero.Fs, 0, len(mounts))
+			for i := len(mounts) - 1; i >= 0; i-- {
+				stack = append(stack, mounts[i].src)
+			}
+			return stack
+		}
+	}
+	return nil
+}
+
+// findMount returns the topmost layer for name, all modifications go there
 func (m *MountFs) findMount(name string) (string, afero.Fs) {
+	top := m.findLayers(name)[0]
+	return top.name, top.Fs
+}
+
+// childMounts returns names of entries inside the dir which lead to mountpoints
+func (m *MountFs) childMounts(name string, withHidden bool) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.childMountsLocked(name, withHidden)
+}
+
+func (m *MountFs) childMountsLocked(name string, withHidden bool) []string {
 	aname := absPath(name)
+	children := make([]string, 0)
 	for _, mpath := range m.paths {
-		mounts := m.mounts[mpath]
-		if len(mounts) > 0 && strings.HasPrefix(aname, mpath) {
-			mname := absPath(aname[len(mpath):])
-			mount := mounts[len(mounts)-1]
-			return mname, mount
+		if mpath == aname || !hasPathPrefix(mpath, aname) {
+			continue
+		}
+		mounts := m.visibleMounts(mpath)
+		if !withHidden {
+			mounts = slices.DeleteFunc(slices.Clone(mounts), func(mount *mount) bool {
+				return mount.opts.Hidden
+			})
 		}
+		if len(mounts) == 0 {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(mpath, aname), string(filepath.Separator))
+		child, _, _ := strings.Cut(rel, string(filepath.Separator))
+		children = append(children, child)
 	}
-	return name, m.base
+	return children
+}
+
+// union calls fn on every layer top-down falling through
+// to the next one while the file does not exist
+func union[T any](layers []layer, fn func(layer) (T, error)) (res T, err error) {
+	for _, l := range layers {
+		res, err = fn(l)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return res, err
+		}
+	}
+	return res, err
+}
+
+// isWriteFlag reports if OpenFile flag may modify the file
+func isWriteFlag(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0
 }
 
 func (m *MountFs) Chtimes(mname string, atime, mtime time.Time) (err error) {
@@ -123,8 +352,9 @@ func (m *MountFs) Chown(mname string, uid int, gid int) (err error) {
 }
 
 func (m *MountFs) Stat(mname string) (fi os.FileInfo, err error) {
-	mname, mount := m.findMount(mname)
-	return mount.Stat(mname)
+	return union(m.findLayers(mname), func(l layer) (os.FileInfo, error) {
+		return l.Stat(l.name)
+	})
 }
 
 func (m *MountFs) Rename(oldname, newname string) (err error) {
@@ -147,21 +377,27 @@ func (m *MountFs) Remove(name string) (err error) {
 }
 
 func (m *MountFs) OpenFile(name string, flag int, mode os.FileMode) (f afero.File, err error) {
-	mname, mount := m.findMount(name)
-	fh, err := mount.OpenFile(mname, flag, mode)
+	layers := m.findLayers(name)
+	if isWriteFlag(flag) {
+		layers = layers[:1]
+	}
+	fh, err := union(layers, func(l layer) (afero.File, error) {
+		return l.OpenFile(l.name, flag, mode)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &MountFile{File: fh, name: name}, nil
+	return &MountFile{File: fh, name: name, fs: m}, nil
 }
 
 func (m *MountFs) Open(name string) (f afero.File, err error) {
-	mname, mount := m.findMount(name)
-	fh, err := mount.Open(mname)
+	fh, err := union(m.findLayers(name), func(l layer) (afero.File, error) {
+		return l.Open(l.name)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &MountFile{File: fh, name: name}, nil
+	return &MountFile{File: fh, name: name, fs: m}, nil
 }
 
 func (m *MountFs) Mkdir(name string, mode os.FileMode) (err error) {
@@ -180,27 +416,186 @@ func (m *MountFs) Create(name string) (f afero.File, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MountFile{File: fh, name: name}, nil
+	return &MountFile{File: fh, name: name, fs: m}, nil
 }
 
 func (m *MountFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
-	mname, mount := m.findMount(name)
-	if lstater, ok := mount.(afero.Lstater); ok {
-		return lstater.LstatIfPossible(mname)
+	type lstat struct {
+		fi os.FileInfo
+		ok bool
 	}
-	fi, err := m.base.Stat(name)
-	return fi, false, err
+	res, err := union(m.findLayers(name), func(l layer) (lstat, error) {
+		if lstater, ok := l.Fs.(afero.Lstater); ok {
+			fi, ok, err := lstater.LstatIfPossible(l.name)
+			return lstat{fi, ok}, err
+		}
+		fi, err := l.Stat(l.name)
+		return lstat{fi, false}, err
+	})
+	return res.fi, res.ok, err
 }
 
 func (m *MountFile) Name() string {
 	return m.name
 }
 
+// TransferError passes transfer errors to the file if it wants them
+func (m *MountFile) TransferError(err error) {
+	if fte, ok := m.File.(interface{ TransferError(error) }); ok {
+		fte.TransferError(err)
+	}
+}
+
+// Readdir lists the dir merged from all the layers stacked at the mountpoint
+// and the mountpoints nested in it, entries are unique by name
+func (m *MountFile) Readdir(count int) ([]os.FileInfo, error) {
+	if m.entries == nil {
+		entries, err := m.fs.readdir(m.name)
+		if err != nil {
+			return nil, err
+		}
+		m.entries = entries
+	}
+	entries := m.entries[m.offset:]
+	if count <= 0 {
+		m.offset = len(m.entries)
+		return entries, nil
+	}
+	if len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(entries) {
+		count = len(entries)
+	}
+	m.offset += count
+	return entries[:count], nil
+}
+
+func (m *MountFile) Readdirnames(n int) ([]string, error) {
+	entries, err := m.Readdir(n)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, err
+}
+
+func (m *MountFs) readdir(name string) ([]os.FileInfo, error) {
+	seen := make(map[string]struct{})
+	entries := make([]os.FileInfo, 0)
+	for _, child := range m.childMounts(name, false) {
+		if _, ok := seen[child]; ok {
+			continue
+		}
+		seen[child] = struct{}{}
+		entries = append(entries, m.mountInfo(filepath.Join(absPath(name), child)))
+	}
+	// dirs created in base for mountpoints are listed only if visible
+	all := &MountFs{mountTable: m.mountTable}
+	mountDirs := all.childMounts(name, true)
+	layers := m.findLayers(name)
+	found := false
+	var lastErr error
+	for _, l := range layers {
+		if l.base && len(layers) > 1 {
+			continue
+		}
+		layerEntries, err := readdirLayer(l.Fs, l.name)
+		if errors.Is(err, fs.ErrNotExist) {
+			lastErr = err
+			continue
+		}
+		// a listing missing entries of a failed layer is not reported as complete
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range layerEntries {
+			if _, ok := seen[entry.Name()]; ok {
+				continue
+			}
+			if l.base && slices.Contains(mountDirs, entry.Name()) {
+				continue
+			}
+			seen[entry.Name()] = struct{}{}
+			entries = append(entries, entry)
+		}
+	}
+	if !found && len(entries) == 0 {
+		return nil, lastErr
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func readdirLayer(layer afero.Fs, name string) ([]os.FileInfo, error) {
+	dir, err := layer.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdir(-1)
+}
+
+// mountInfo describes a mountpoint or a dir leading to it
+func (m *MountFs) mountInfo(name string) os.FileInfo {
+	fi, err := m.Stat(name)
+	if err != nil || !fi.IsDir() {
+		fi = nil
+	}
+	return &mountInfo{FileInfo: fi, name: filepath.Base(name)}
+}
+
+func (m *mountInfo) Name() string {
+	return m.name
+}
+
+func (m *mountInfo) IsDir() bool {
+	return true
+}
+
+func (m *mountInfo) Mode() os.FileMode {
+	if m.FileInfo == nil {
+		return os.ModeDir | 0755
+	}
+	return m.FileInfo.Mode()
+}
+
+func (m *mountInfo) Size() int64 {
+	if m.FileInfo == nil {
+		return 0
+	}
+	return m.FileInfo.Size()
+}
+
+func (m *mountInfo) ModTime() time.Time {
+	if m.FileInfo == nil {
+		return time.Time{}
+	}
+	return m.FileInfo.ModTime()
+}
+
+func (m *mountInfo) Sys() any {
+	if m.FileInfo == nil {
+		return nil
+	}
+	return m.FileInfo.Sys()
+}
+
+// absPath makes name absolute and clean so it never escapes the root
 func absPath(name string) string {
-	if !filepath.IsAbs(name) {
-		return filepath.Join(string(filepath.Separator), name)
+	return filepath.Join(string(filepath.Separator), name)
+}
+
+// hasPathPrefix reports if name is the prefix itself or lies under it,
+// both expected to be clean absolute paths
+func hasPathPrefix(name, prefix string) bool {
+	if prefix == string(filepath.Separator) || name == prefix {
+		return true
 	}
-	return name
+	return strings.HasPrefix(name, prefix+string(filepath.Separator))
 }
 
 type keyFunc func(string) int
@@ -1,7 +1,13 @@
 package aferomount
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -77,6 +83,47 @@ func TestMountfsOverlappingMounts(t *testing.T) {
 	assert.Equal(t, string(got), expected)
 }
 
+func TestMountfsUnion(t *testing.T) {
+	var afs afero.Afero
+
+	memfs1 := afero.NewMemMapFs()
+	afs = afero.Afero{Fs: memfs1}
+	assert.NoError(t, afs.WriteFile("/a/file.txt", []byte("/a/file.txt: memfs1"), 0644))
+	assert.NoError(t, afs.WriteFile("/a/big.bin", []byte("/a/big.bin: memfs1"), 0644))
+
+	memfs2 := afero.NewMemMapFs()
+	afs = afero.Afero{Fs: memfs2}
+	assert.NoError(t, afs.WriteFile("/a/file.txt", []byte("/a/file.txt: memfs2"), 0644))
+
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	afs = afero.Afero{Fs: mountfs}
+	assert.NoError(t, mountfs.Mount(memfs1, "/"))
+	assert.NoError(t, mountfs.Mount(memfs2, "/"))
+
+	got, err := afs.ReadFile("/a/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/file.txt: memfs2", string(got))
+
+	got, err = afs.ReadFile("/a/big.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/big.bin: memfs1", string(got), "expected fall through to lower layer")
+
+	stat, err := afs.Stat("/a/big.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("/a/big.bin: memfs1")), stat.Size())
+
+	_, err = afs.Stat("/a/missing.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.NoError(t, afs.WriteFile("/a/new.txt", []byte("/a/new.txt"), 0644))
+	exists, err := afero.Exists(memfs2, "/a/new.txt")
+	assert.NoError(t, err)
+	assert.True(t, exists, "expected writes to go to the top layer")
+	exists, err = afero.Exists(memfs1, "/a/new.txt")
+	assert.NoError(t, err)
+	assert.False(t, exists, "expected lower layer untouched")
+}
+
 func TestMountDirCreated(t *testing.T) {
 	var afs afero.Afero
 
@@ -149,6 +196,313 @@ func TestMountDirCreatedOverlap(t *testing.T) {
 	assert.True(t, stat.IsDir(), "expected /a should be a dir")
 }
 
+func TestMountfsReaddir(t *testing.T) {
+	var afs afero.Afero
+
+	memfs1 := afero.NewMemMapFs()
+	afs = afero.Afero{Fs: memfs1}
+	assert.NoError(t, afs.MkdirAll("/a", 0755))
+	assert.NoError(t, afs.WriteFile("/file.txt", []byte("/file.txt: memfs1"), 0644))
+
+	memfs2 := afero.NewMemMapFs()
+	afs = afero.Afero{Fs: memfs2}
+	assert.NoError(t, afs.MkdirAll("/b", 0755))
+	assert.NoError(t, afs.WriteFile("/file.txt", []byte("/file.txt: memfs2"), 0644))
+
+	memfs3 := afero.NewMemMapFs()
+	afs = afero.Afero{Fs: memfs3}
+	assert.NoError(t, afs.WriteFile("/nested.txt", []byte("/nested.txt: memfs3"), 0644))
+
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	afs = afero.Afero{Fs: mountfs}
+	assert.NoError(t, mountfs.Mount(memfs1, "/"))
+	assert.NoError(t, mountfs.Mount(memfs2, "/"))
+	assert.NoError(t, mountfs.Mount(memfs3, "/c/d"))
+
+	names := func(dir string) []string {
+		entries, err := afs.ReadDir(dir)
+		assert.NoError(t, err)
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a", "b", "c", "file.txt"}, names("/"))
+	assert.Equal(t, []string{"d"}, names("/c"))
+	assert.Equal(t, []string{"nested.txt"}, names("/c/d"))
+
+	stat, err := afs.Stat("/c")
+	assert.NoError(t, err)
+	assert.True(t, stat.IsDir(), "expected /c to be a dir leading to mountpoint")
+
+	dir, err := mountfs.Open("/")
+	assert.NoError(t, err)
+	got, err := dir.Readdirnames(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, got)
+	got, err = dir.Readdirnames(3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file.txt"}, got)
+	_, err = dir.Readdirnames(3)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// failingFs fails opening anything but missing files
+type failingFs struct {
+	afero.Fs
+}
+
+func (m failingFs) Open(name string) (afero.File, error) {
+	if _, err := m.Fs.Stat(name); err != nil {
+		return nil, err
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("backend unavailable")}
+}
+
+func TestMountfsReaddirLayerError(t *testing.T) {
+	lower := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(lower, "/lower.txt", []byte("lower"), 0644))
+	upper := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(upper, "/upper.txt", []byte("upper"), 0644))
+	assert.NoError(t, upper.MkdirAll("/a", 0755))
+
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	assert.NoError(t, mountfs.Mount(lower, "/"))
+	assert.NoError(t, mountfs.Mount(failingFs{upper}, "/"))
+
+	// layers missing the dir are skipped
+	lowerOnly := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(lowerOnly, "/b/lower.txt", []byte("lower"), 0644))
+	assert.NoError(t, mountfs.Mount(lowerOnly, "/"))
+	entries, err := afero.ReadDir(mountfs, "/b")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = afero.ReadDir(mountfs, "/")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestMountfsUmountKeepsOtherMounts(t *testing.T) {
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	afs := afero.Afero{Fs: mountfs}
+	for _, path := range []string{"/a", "/bb", "/ccc"} {
+		memfs := afero.NewMemMapFs()
+		assert.NoError(t, afero.WriteFile(memfs, "/file.txt", []byte(path), 0644))
+		assert.NoError(t, mountfs.Mount(memfs, path))
+	}
+
+	assert.NoError(t, mountfs.Umount("/a"))
+	for _, path := range []string{"/bb", "/ccc"} {
+		got, err := afs.ReadFile(path + "/file.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, path, string(got))
+	}
+	_, err := afs.ReadFile("/a/file.txt")
+	assert.Error(t, err)
+}
+
+func TestMountfsUmountFs(t *testing.T) {
+	newFs := func(content string) afero.Fs {
+		memfs := afero.NewMemMapFs()
+		assert.NoError(t, afero.WriteFile(memfs, "/file.txt", []byte(content), 0644))
+		return memfs
+	}
+	memfs1 := newFs("memfs1")
+	memfs2 := newFs("memfs2")
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	afs := afero.Afero{Fs: mountfs}
+	assert.NoError(t, mountfs.MountWithOptions(memfs1, "/", MountOptions{ReadOnly: true}))
+	assert.NoError(t, mountfs.Mount(memfs2, "/"))
+
+	opened, err := mountfs.Open("/file.txt")
+	assert.NoError(t, err)
+	defer opened.Close()
+
+	assert.NoError(t, mountfs.UmountFs(memfs2, "/"))
+	assert.Error(t, mountfs.UmountFs(memfs2, "/"), "expected memfs2 to be unmounted")
+	got, err := afs.ReadFile("/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "memfs1", string(got))
+
+	got, err = io.ReadAll(opened)
+	assert.NoError(t, err)
+	assert.Equal(t, "memfs2", string(got), "expected opened file to be served by unmounted fs")
+
+	assert.NoError(t, mountfs.UmountFs(memfs1, "/"))
+	assert.Empty(t, mountfs.Mounts())
+}
+
+func TestMountfsMounts(t *testing.T) {
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	assert.NoError(t, mountfs.Mount(afero.NewMemMapFs(), "/b"))
+	assert.NoError(t, mountfs.Mount(afero.NewMemMapFs(), "/"))
+	assert.NoError(t, mountfs.Mount(afero.NewReadOnlyFs(afero.NewMemMapFs()), "/"))
+
+	expected := []MountEntry{
+		{Path: "/", Layer: 0, Backend: "MemMapFS"},
+		{Path: "/", Layer: 1, Backend: "ReadOnlyFilter"},
+		{Path: "/b", Layer: 0, Backend: "MemMapFS"},
+	}
+	assert.Equal(t, expected, mountfs.Mounts())
+
+	assert.NoError(t, mountfs.Umount("/"))
+	expected = []MountEntry{
+		{Path: "/", Layer: 0, Backend: "MemMapFS"},
+		{Path: "/b", Layer: 0, Backend: "MemMapFS"},
+	}
+	assert.Equal(t, expected, mountfs.Mounts())
+}
+
+func TestMountfsConcurrentMount(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/file.txt", []byte("file contents"), 0644))
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	assert.NoError(t, mountfs.Mount(memfs, "/"))
+	afs := afero.Afero{Fs: mountfs}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		path := fmt.Sprintf("/mnt%d", i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, mountfs.Mount(memfs, path))
+				assert.NoError(t, mountfs.Umount(path))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				got, err := afs.ReadFile("/file.txt")
+				assert.NoError(t, err)
+				assert.Equal(t, "file contents", string(got))
+				_, err = afs.ReadDir("/")
+				assert.NoError(t, err)
+				mountfs.Mounts()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, mountfs.Mounts(), 1)
+}
+
+func TestMountfsFindMount(t *testing.T) {
+	mounts := map[string]afero.Fs{
+		"/":            afero.NewMemMapFs(),
+		"/img":         afero.NewMemMapFs(),
+		"/img/nested/": afero.NewMemMapFs(),
+		"/customer-a":  afero.NewMemMapFs(),
+		"/customer-ab": afero.NewMemMapFs(),
+	}
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	for path, fs := range mounts {
+		assert.NoError(t, mountfs.Mount(fs, path))
+	}
+
+	tests := []struct {
+		name      string
+		wantMount string
+		wantName  string
+	}{
+		{"/img/foo.bin", "/img", "/foo.bin"},
+		{"/images/foo.bin", "/", "/images/foo.bin"},
+		{"/img", "/img", "/"},
+		{"/img/", "/img", "/"},
+		{"img/foo.bin", "/img", "/foo.bin"},
+		{"//img//foo.bin", "/img", "/foo.bin"},
+		{"/img/./foo.bin", "/img", "/foo.bin"},
+		{"/img/../images/foo.bin", "/", "/images/foo.bin"},
+		{"/img/../../../etc/passwd", "/", "/etc/passwd"},
+		{"/img/nested/foo.bin", "/img/nested/", "/foo.bin"},
+		{"/img/nested", "/img/nested/", "/"},
+		{"/img/nestedfoo.bin", "/img", "/nestedfoo.bin"},
+		{"/img/nested/../foo.bin", "/img", "/foo.bin"},
+		{"/img/nested/../../foo.bin", "/", "/foo.bin"},
+		{"/customer-a/foo.bin", "/customer-a", "/foo.bin"},
+		{"/customer-ab/foo.bin", "/customer-ab", "/foo.bin"},
+		{"/customer-abc/foo.bin", "/", "/customer-abc/foo.bin"},
+		{"/", "/", "/"},
+		{"", "/", "/"},
+		{"..", "/", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotName, gotMount := mountfs.findMount(tt.name)
+			assert.Equal(t, tt.wantName, gotName)
+			assert.True(t, mounts[tt.wantMount] == gotMount, "expected mount %s", tt.wantMount)
+		})
+	}
+}
+
+func TestMountfsTrailingSlash(t *testing.T) {
+	memfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(memfs, "/file.txt", []byte("file contents"), 0644))
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	afs := afero.Afero{Fs: mountfs}
+
+	assert.NoError(t, mountfs.Mount(memfs, "/a/"))
+	got, err := afs.ReadFile("/a/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "file contents", string(got))
+	_, err = afs.ReadFile("/ab/file.txt")
+	assert.Error(t, err)
+
+	assert.NoError(t, mountfs.Umount("/a"))
+	assert.Empty(t, mountfs.Mounts())
+}
+
+func TestMountfsOptions(t *testing.T) {
+	newFs := func(content string) afero.Fs {
+		memfs := afero.NewMemMapFs()
+		assert.NoError(t, afero.WriteFile(memfs, "/file.txt", []byte(content), 0644))
+		return memfs
+	}
+	mountfs := NewMountFS(afero.NewMemMapFs())
+	assert.NoError(t, mountfs.MountWithOptions(newFs("ro"), "/ro", MountOptions{ReadOnly: true}))
+	assert.NoError(t, mountfs.MountWithOptions(newFs("rw"), "/rw", MountOptions{}))
+	assert.NoError(t, mountfs.MountWithOptions(newFs("hidden"), "/hidden", MountOptions{Hidden: true}))
+	assert.NoError(t, mountfs.MountWithOptions(newFs("tftp"), "/legacy", MountOptions{Protocols: []string{"tftp"}}))
+	assert.NoError(t, mountfs.MountWithOptions(newFs("high"), "/prio", MountOptions{Priority: 10}))
+	assert.NoError(t, mountfs.MountWithOptions(newFs("low"), "/prio", MountOptions{Priority: 0}))
+	afs := afero.Afero{Fs: mountfs}
+
+	assert.Error(t, afs.WriteFile("/ro/new.txt", []byte("new"), 0644), "expected ro mount to deny writes")
+	assert.NoError(t, afs.WriteFile("/rw/new.txt", []byte("new"), 0644))
+
+	got, err := afs.ReadFile("/prio/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "high", string(got), "expected higher priority on top")
+
+	got, err = afs.ReadFile("/hidden/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "hidden", string(got), "expected hidden mount to be accessible")
+
+	names := func(fs afero.Fs) []string {
+		entries, err := afero.ReadDir(fs, "/")
+		assert.NoError(t, err)
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"legacy", "prio", "ro", "rw"}, names(mountfs))
+
+	tftpfs := mountfs.ForProtocol("tftp")
+	got, err = afero.ReadFile(tftpfs, "/legacy/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "tftp", string(got))
+	assert.Equal(t, []string{"legacy", "prio", "ro", "rw"}, names(tftpfs))
+
+	httpfs := mountfs.ForProtocol("http")
+	_, err = afero.ReadFile(httpfs, "/legacy/file.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist, "expected tftp only mount to be invisible over http")
+	assert.Equal(t, []string{"prio", "ro", "rw"}, names(httpfs))
+}
+
 func TestInsertSorted(t *testing.T) {
 	var slice []string
 	var expected string
@@ -0,0 +1,448 @@
+package aferooci
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/afero"
+)
+
+// TitleAnnotation names layers as files
+const TitleAnnotation = "org.opencontainers.image.title"
+
+// CreatedAnnotation of the manifest is reported as modification time of files
+const CreatedAnnotation = "org.opencontainers.image.created"
+
+// DefaultPoll is how often tags are checked for a new manifest
+const DefaultPoll = time.Minute
+
+// OciFs is a read-only afero.Fs of layers of an artifact in OCI registry
+// named by their title annotations, the manifest is resolved on first use
+// and blobs are verified against their digests once read to the end
+type OciFs struct {
+	Poll       time.Duration // check tags for a new manifest digest this often, zero never
+	ref        name.Reference
+	opts       []remote.Option
+	loadMu     sync.Mutex        // one request of the manifest at a time
+	mu         sync.Mutex        // guards entries, digest, checked and refreshing
+	entries    map[string]*entry // by clean path, nil until resolved
+	digest     v1.Hash           // of the manifest resolved
+	checked    time.Time
+	refreshing bool
+}
+
+// entry is a layer or a dir of titles with slashes
+type entry struct {
+	info     *FileInfo
+	children []*FileInfo // of dirs sorted by name
+	digest   v1.Hash
+}
+
+// File is a layer read from the registry, reads are sequential,
+// seeking backwards fetches the blob again, reads stopping before
+// the end of the blob such as ReadAt and ranges are not verified
+type File struct {
+	fs     *OciFs
+	name   string
+	entry  *entry
+	r      io.ReadCloser
+	pos    int64 // position of r
+	offset int64 // position to read from
+	dirAt  int
+	closed bool
+}
+
+// FileInfo of layers, digest serves as ETag
+type FileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	digest  string
+}
+
+func NewOciFs(ref name.Reference, opts ...remote.Option) *OciFs {
+	return &OciFs{Poll: DefaultPoll, ref: ref, opts: opts}
+}
+
+func (m *OciFs) Name() string {
+	return "OciFs"
+}
+
+// resolve returns entries of the manifest fetched before, once Poll passed
+// tags are checked in the background while lookups keep the current entries
+func (m *OciFs) resolve() (map[string]*entry, error) {
+	m.mu.Lock()
+	if entries := m.entries; entries != nil {
+		_, pinned := m.ref.(name.Digest)
+		if !pinned && m.Poll > 0 && !m.refreshing && time.Since(m.checked) >= m.Poll {
+			m.refreshing = true
+			go m.refresh(m.digest)
+		}
+		m.mu.Unlock()
+		return entries, nil
+	}
+	m.mu.Unlock()
+	// the first fetch is waited for as there is nothing to serve before it
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+	m.mu.Lock()
+	entries := m.entries
+	m.mu.Unlock()
+	if entries != nil {
+		return entries, nil
+	}
+	entries, digest, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.entries, m.digest, m.checked = entries, digest, time.Now()
+	m.mu.Unlock()
+	return entries, nil
+}
+
+// refresh fetches the manifest again if the digest of the tag changed,
+// failed checks keep the manifest resolved before
+func (m *OciFs) refresh(current v1.Hash) {
+	m.loadMu.Lock()
+	var entries map[string]*entry
+	digest := current
+	// registries failing HEAD are checked with GET
+	head, err := remote.Head(m.ref, m.opts...)
+	if err != nil || head.Digest != current {
+		entries, digest, err = m.load()
+	}
+	m.loadMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshing, m.checked = false, time.Now()
+	if err != nil {
+		log.Printf("%s: %s, serving manifest %s", m.ref, err, current)
+		return
+	}
+	if entries != nil {
+		m.entries, m.digest = entries, digest
+	}
+}
+
+// load fetches the manifest and makes entries of its layers
+func (m *OciFs) load() (map[string]*entry, v1.Hash, error) {
+	desc, err := remote.Get(m.ref, m.opts...)
+	if err != nil {
+		return nil, v1.Hash{}, err
+	}
+	if desc.MediaType.IsIndex() {
+		return nil, v1.Hash{}, fmt.Errorf("%s: expected manifest of an artifact, got %s", m.ref, desc.MediaType)
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return nil, v1.Hash{}, fmt.Errorf("%s: %w", m.ref, err)
+	}
+	modTime, _ := time.Parse(time.RFC3339, manifest.Annotations[CreatedAnnotation])
+	entries := map[string]*entry{
+		"/": {info: &FileInfo{name: "/", mode: os.ModeDir | 0555, modTime: modTime}},
+	}
+	var mkdir func(name string) *entry
+	mkdir = func(name string) *entry {
+		if e, ok := entries[name]; ok {
+			return e
+		}
+		e := &entry{info: &FileInfo{name: path.Base(name), mode: os.ModeDir | 0555, modTime: modTime}}
+		entries[name] = e
+		parent := mkdir(path.Dir(name))
+		parent.children = append(parent.children, e.info)
+		return e
+	}
+	for _, layer := range manifest.Layers {
+		title := layer.Annotations[TitleAnnotation]
+		name := path.Clean("/" + title)
+		if title == "" || name == "/" {
+			continue // layers without title are not files
+		}
+		if _, ok := entries[name]; ok {
+			continue // first layer of the title wins
+		}
+		e := &entry{
+			info:   &FileInfo{name: path.Base(name), size: layer.Size, mode: 0444, modTime: modTime, digest: layer.Digest.String()},
+			digest: layer.Digest,
+		}
+		entries[name] = e
+		parent := mkdir(path.Dir(name))
+		parent.children = append(parent.children, e.info)
+	}
+	for _, e := range entries {
+		sort.Slice(e.children, func(i, j int) bool { return e.children[i].name < e.children[j].name })
+	}
+	return entries, desc.Digest, nil
+}
+
+func (m *OciFs) lookup(op, name string) (*entry, error) {
+	entries, err := m.resolve()
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	e, ok := entries[path.Clean("/"+filepath.ToSlash(name))]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// blob fetches the layer, the reader fails at the end if digest mismatches
+func (m *OciFs) blob(digest v1.Hash) (io.ReadCloser, error) {
+	layer, err := remote.Layer(m.ref.Context().Digest(digest.String()), m.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return layer.Compressed()
+}
+
+func (m *OciFs) Stat(name string) (os.FileInfo, error) {
+	e, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (m *OciFs) Open(name string) (afero.File, error) {
+	e, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &File{fs: m, name: name, entry: e}, nil
+}
+
+func (m *OciFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	return m.Open(name)
+}
+
+func (m *OciFs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) Rename(oldname, newname string) error {
+	return &os.PathError{Op: "rename", Path: oldname, Err: syscall.EPERM}
+}
+
+func (m *OciFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+func (m *OciFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+func (m *File) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	if m.r != nil {
+		return m.r.Close()
+	}
+	return nil
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	if m.entry.info.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	size := m.entry.info.size
+	if m.offset >= size {
+		return 0, io.EOF
+	}
+	if m.r == nil || m.pos > m.offset {
+		if m.r != nil {
+			m.r.Close()
+		}
+		r, err := m.fs.blob(m.entry.digest)
+		if err != nil {
+			return 0, &os.PathError{Op: "read", Path: m.name, Err: err}
+		}
+		m.r, m.pos = r, 0
+	}
+	if m.pos < m.offset {
+		n, err := io.CopyN(io.Discard, m.r, m.offset-m.pos)
+		m.pos += n
+		if err != nil {
+			return 0, &os.PathError{Op: "read", Path: m.name, Err: unexpectedEOF(err)}
+		}
+	}
+	n, err := m.r.Read(p[:min(int64(len(p)), size-m.offset)])
+	m.pos += int64(n)
+	if err == nil && m.pos == size {
+		// digest is verified reading past the end
+		if _, err = io.Copy(io.Discard, m.r); err == nil {
+			err = io.EOF
+		}
+	}
+	if err == io.EOF && m.pos < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		// the last bytes are held back so a blob failing its digest is never complete
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: err}
+	}
+	m.offset += int64(n)
+	return n, err
+}
+
+// ReadAt moves the position of sequential reads, ranges ending
+// before the end of the blob are not verified
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := m.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(m, p)
+	if err == io.ErrUnexpectedEOF && m.offset >= m.entry.info.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	if m.entry.info.IsDir() {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EISDIR}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.entry.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EINVAL}
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *File) Stat() (os.FileInfo, error) {
+	return m.entry.info, nil
+}
+
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !m.entry.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+	}
+	rest := m.entry.children[m.dirAt:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(count, len(rest))]
+	}
+	m.dirAt += len(rest)
+	infos := make([]os.FileInfo, len(rest))
+	for i, info := range rest {
+		infos[i] = info
+	}
+	return infos, nil
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *FileInfo) Name() string {
+	return m.name
+}
+
+func (m *FileInfo) Size() int64 {
+	return m.size
+}
+
+func (m *FileInfo) Mode() os.FileMode {
+	return m.mode
+}
+
+func (m *FileInfo) ModTime() time.Time {
+	return m.modTime
+}
+
+func (m *FileInfo) IsDir() bool {
+	return m.mode.IsDir()
+}
+
+func (m *FileInfo) Sys() any {
+	return nil
+}
+
+// ETag is the digest of the layer
+func (m *FileInfo) ETag() string {
+	return m.digest
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package aferooci
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// pushForTest pushes artifact with a layer of every title
+func pushForTest(t *testing.T, ref name.Reference, layers map[string]string) {
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	img = mutate.ConfigMediaType(img, "application/vnd.xtproxy.firmware.config.v1+json")
+	for title, data := range layers {
+		var err error
+		img, err = mutate.Append(img, mutate.Addendum{
+			Layer:       static.NewLayer([]byte(data), "application/octet-stream"),
+			Annotations: map[string]string{TitleAnnotation: title},
+		})
+		assert.NoError(t, err)
+	}
+	img = mutate.Annotations(img, map[string]string{CreatedAnnotation: "2024-06-01T12:00:00Z"}).(v1.Image)
+	assert.NoError(t, remote.Write(ref, img))
+}
+
+// registryForTest serves registry corrupting the last byte of blobs named corrupt
+func registryForTest(t *testing.T, corrupt *string) string {
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *corrupt == "" || r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/blobs/"+*corrupt) {
+			reg.ServeHTTP(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, r)
+		body := rec.Body.Bytes()
+		body[len(body)-1] ^= 0xff
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestOciFs(t *testing.T) {
+	corrupt := ""
+	addr := registryForTest(t, &corrupt)
+	image := strings.Repeat("switch image ", 1000)
+	ref, err := name.ParseReference(addr+"/firmware/switch:v1", name.Insecure)
+	assert.NoError(t, err)
+	pushForTest(t, ref, map[string]string{
+		"switch.bin":     image,
+		"cfg/a.conf":     "hostname a",
+		"cfg/b.conf":     "hostname b",
+		"release-notes":  "notes",
+		"../escape.conf": "escape",
+	})
+
+	ocifs := NewOciFs(ref)
+	got, err := afero.ReadFile(ocifs, "/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, image, string(got))
+	got, err = afero.ReadFile(ocifs, "/cfg/b.conf")
+	assert.NoError(t, err)
+	assert.Equal(t, "hostname b", string(got))
+	info, err := ocifs.Stat("/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(image)), info.Size())
+	assert.Equal(t, 2024, info.ModTime().Year())
+	assert.True(t, strings.HasPrefix(info.(*FileInfo).ETag(), "sha256:"))
+	_, err = ocifs.Stat("/missing.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	names := []string{}
+	dir, err := ocifs.Open("/")
+	assert.NoError(t, err)
+	for {
+		page, err := dir.Readdirnames(2)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, page...)
+	}
+	assert.Equal(t, []string{"cfg", "escape.conf", "release-notes", "switch.bin"}, names)
+
+	f, err := ocifs.Open("/switch.bin")
+	assert.NoError(t, err)
+	buf := make([]byte, 12)
+	_, err = f.ReadAt(buf, 13*500)
+	assert.NoError(t, err)
+	assert.Equal(t, "switch image", string(buf))
+	_, err = f.ReadAt(buf, 13*10+7)
+	assert.NoError(t, err)
+	assert.Equal(t, "image switch", string(buf))
+	assert.NoError(t, f.Close())
+
+	_, err = ocifs.OpenFile("/switch.bin", os.O_WRONLY, 0644)
+	assert.ErrorIs(t, err, syscall.EPERM)
+
+	// blob not matching its digest fails the read at the end holding back its last bytes
+	corrupt = info.(*FileInfo).ETag()
+	f, err = ocifs.Open("/switch.bin")
+	assert.NoError(t, err)
+	got, err = io.ReadAll(f)
+	assert.Error(t, err)
+	assert.Contains(t, fmt.Sprint(err), "checksum")
+	assert.Less(t, len(got), len(image))
+	assert.NoError(t, f.Close())
+	corrupt = ""
+
+	_, err = NewOciFs(ref.Context().Tag("missing")).Stat("/switch.bin")
+	assert.Error(t, err)
+}
+
+func TestOciFsTagMoved(t *testing.T) {
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	var stalled atomic.Bool
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stalled.Load() && strings.Contains(r.URL.Path, "/manifests/") {
+			<-release
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	ref, err := name.ParseReference(strings.TrimPrefix(server.URL, "http://")+"/firmware/switch:latest", name.Insecure)
+	assert.NoError(t, err)
+	pushForTest(t, ref, map[string]string{"switch.bin": "first"})
+
+	ocifs := NewOciFs(ref)
+	ocifs.Poll = time.Millisecond
+	pinned := NewOciFs(ref)
+	pinned.Poll = 0
+	for _, fs := range []*OciFs{ocifs, pinned} {
+		got, err := afero.ReadFile(fs, "/switch.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(got))
+	}
+
+	// lookups do not wait for the registry checking the tag
+	stalled.Store(true)
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		_, err = ocifs.Stat("/switch.bin")
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	}
+	stalled.Store(false)
+	close(release)
+
+	pushForTest(t, ref, map[string]string{"switch.bin": "second"})
+	assert.Eventually(t, func() bool {
+		got, err := afero.ReadFile(ocifs, "/switch.bin")
+		return err == nil && string(got) == "second"
+	}, 5*time.Second, time.Millisecond)
+	got, err := afero.ReadFile(pinned, "/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(got))
+}
@@ -0,0 +1,281 @@
+package aferos3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	afero_s3 "github.com/fclairamb/afero-s3"
+	"github.com/spf13/afero"
+)
+
+// PartSize of multipart uploads, uploads hold up to Concurrency+1 parts in memory
+// and are limited to 10000 parts by s3
+const PartSize = 8 << 20
+
+// Concurrency is the number of parts of an upload sent at once
+const Concurrency = 2
+
+// S3Fs is an afero.Fs of s3 bucket streaming writes into multipart uploads
+// objects appear once the file is closed and failed uploads are aborted,
+// reads stick to the object version current on open
+type S3Fs struct {
+	*afero_s3.Fs
+	Pinned        time.Time // reads see objects current at this time, zero for the latest
+	PinnedVersion string    // reads see the version and objects current when it was written
+	bucket        string
+	client        *s3.S3
+	uploader      *s3manager.Uploader
+	pinMu         sync.Mutex
+	pin           *object // PinnedVersion found on first use
+}
+
+// UploadFile streams writes into the upload completed on Close
+// or aborted once TransferError reports the transfer failed
+type UploadFile struct {
+	name   string
+	pw     *io.PipeWriter
+	offset int64
+	failed error         // transfer error aborting the upload
+	done   chan struct{} // closed once upload returns
+	err    error         // result of upload, set before done
+	closed bool
+}
+
+func NewS3Fs(bucket string, sess *session.Session) *S3Fs {
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		u.PartSize = PartSize
+		u.Concurrency = Concurrency
+	})
+	return &S3Fs{
+		Fs:       afero_s3.NewFs(bucket, sess),
+		bucket:   bucket,
+		client:   s3.New(sess),
+		uploader: uploader,
+	}
+}
+
+func (m *S3Fs) Name() string {
+	return "S3Fs"
+}
+
+// Stat takes a missing object for a dir if there are objects under name/,
+// afero-s3 matches any object prefixed with name and fails on servers omitting KeyCount
+func (m *S3Fs) Stat(name string) (os.FileInfo, error) {
+	clean := path.Clean("/" + filepath.ToSlash(name))
+	if clean == "/" {
+		return afero_s3.NewFileInfo("/", true, 0, time.Unix(0, 0)), nil
+	}
+	obj, err := m.resolve(name)
+	if err == nil {
+		return afero_s3.NewFileInfo(path.Base(clean), false, obj.size, obj.modTime), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if _, err := m.dir(name); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return afero_s3.NewFileInfo(path.Base(clean), true, 0, time.Unix(0, 0)), nil
+}
+
+// dir checks there are objects under name/ returning entries of pinned dirs
+func (m *S3Fs) dir(name string) ([]os.FileInfo, error) {
+	clean := path.Clean("/" + filepath.ToSlash(name))
+	if m.isPinned() {
+		entries, err := m.pinnedDir(name)
+		if err == nil && len(entries) == 0 && clean != "/" {
+			err = fs.ErrNotExist
+		}
+		return entries, err
+	}
+	if clean == "/" {
+		return nil, nil
+	}
+	list, err := m.client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(m.bucket),
+		Prefix:  aws.String(strings.TrimPrefix(clean, "/") + "/"),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Contents) == 0 && len(list.CommonPrefixes) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return nil, nil
+}
+
+func (m *S3Fs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (m *S3Fs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile starts an upload for write flags, objects can only be replaced as a whole
+func (m *S3Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return m.open(name, flag, perm)
+	}
+	if m.isPinned() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.ErrUnsupported}
+	}
+	if flag&os.O_EXCL != 0 {
+		_, err := m.Stat(name)
+		if err == nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return m.upload(name), nil
+}
+
+// open reads the object version resolved by name or lists the dir
+func (m *S3Fs) open(name string, flag int, perm os.FileMode) (afero.File, error) {
+	obj, err := m.resolve(name)
+	if err == nil {
+		return &ObjectFile{fs: m, name: name, obj: obj}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	entries, err := m.dir(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if m.isPinned() {
+		return &pinnedDir{name: name, entries: entries}, nil
+	}
+	return m.Fs.OpenFile(name, flag, perm)
+}
+
+func (m *S3Fs) upload(name string) *UploadFile {
+	pr, pw := io.Pipe()
+	file := &UploadFile{name: name, pw: pw, done: make(chan struct{})}
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(m.bucket),
+		Key:    aws.String(name),
+		Body:   pr,
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	go func() {
+		defer close(file.done)
+		// parts read so far are dropped and the upload aborted on read errors
+		_, file.err = m.uploader.Upload(input)
+		if file.err != nil {
+			pr.CloseWithError(file.err)
+		}
+	}()
+	return file
+}
+
+func (m *UploadFile) Name() string {
+	return m.name
+}
+
+func (m *UploadFile) Write(p []byte) (int, error) {
+	if m.closed {
+		return 0, afero.ErrFileClosed
+	}
+	n, err := m.pw.Write(p)
+	m.offset += int64(n)
+	if err != nil {
+		return n, &os.PathError{Op: "write", Path: m.name, Err: err}
+	}
+	return n, nil
+}
+
+// WriteAt supports sequential writes only
+func (m *UploadFile) WriteAt(p []byte, off int64) (int, error) {
+	if off != m.offset {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: errors.ErrUnsupported}
+	}
+	return m.Write(p)
+}
+
+func (m *UploadFile) WriteString(s string) (int, error) {
+	return m.Write([]byte(s))
+}
+
+// TransferError aborts the upload on Close
+func (m *UploadFile) TransferError(err error) {
+	m.failed = err
+}
+
+// Close completes the upload making the object visible
+func (m *UploadFile) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	if m.failed != nil {
+		m.pw.CloseWithError(m.failed)
+		<-m.done
+		return &os.PathError{Op: "close", Path: m.name, Err: fmt.Errorf("upload aborted: %w", m.failed)}
+	}
+	m.pw.Close()
+	<-m.done
+	if m.err != nil {
+		return &os.PathError{Op: "close", Path: m.name, Err: m.err}
+	}
+	return nil
+}
+
+// Seek reports the position only, uploads can not be rewound
+func (m *UploadFile) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case whence == io.SeekCurrent && offset == 0, whence == io.SeekStart && offset == m.offset:
+		return m.offset, nil
+	}
+	return 0, &os.PathError{Op: "seek", Path: m.name, Err: errors.ErrUnsupported}
+}
+
+func (m *UploadFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *UploadFile) ReadAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *UploadFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+}
+
+func (m *UploadFile) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+}
+
+func (m *UploadFile) Stat() (os.FileInfo, error) {
+	return nil, &os.PathError{Op: "stat", Path: m.name, Err: errors.ErrUnsupported}
+}
+
+func (m *UploadFile) Sync() error {
+	return nil
+}
+
+func (m *UploadFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: errors.ErrUnsupported}
+}
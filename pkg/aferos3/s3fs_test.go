@@ -0,0 +1,228 @@
+package aferos3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpload(t *testing.T) {
+	afs, client := s3FsForTest(t)
+	contents := bytes.Repeat([]byte("0123456789abcdef"), (PartSize*5/2)/16)
+
+	file, err := afs.Create("/dump.bin")
+	assert.NoError(t, err)
+	for rest := contents; len(rest) > 0; {
+		n, err := file.Write(rest[:min(64<<10, len(rest))])
+		assert.NoError(t, err)
+		rest = rest[n:]
+	}
+	// object appears only once completed
+	_, err = afs.Stat("/dump.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.NoError(t, file.Close())
+
+	got, err := afero.ReadFile(afs, "/dump.bin")
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(contents, got))
+	assert.Empty(t, multipartUploads(t, client))
+
+	// small files are put as is
+	assert.NoError(t, afero.WriteFile(afs, "/small.txt", []byte("small"), 0644))
+	got, err = afero.ReadFile(afs, "/small.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "small", string(got))
+}
+
+func TestUploadAbort(t *testing.T) {
+	afs, client := s3FsForTest(t)
+	for _, size := range []int{100, PartSize * 3 / 2} {
+		file, err := afs.OpenFile("/dump.bin", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		assert.NoError(t, err)
+		_, err = file.Write(make([]byte, size))
+		assert.NoError(t, err)
+		disconnected := errors.New("client disconnected")
+		file.(*UploadFile).TransferError(disconnected)
+		assert.ErrorIs(t, file.Close(), disconnected)
+
+		_, err = afs.Stat("/dump.bin")
+		assert.ErrorIs(t, err, fs.ErrNotExist, size)
+		assert.Empty(t, multipartUploads(t, client), size)
+	}
+}
+
+func TestUploadFlags(t *testing.T) {
+	afs, _ := s3FsForTest(t)
+	assert.NoError(t, afero.WriteFile(afs, "/file.txt", []byte("contents"), 0644))
+
+	_, err := afs.OpenFile("/file.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	assert.ErrorIs(t, err, fs.ErrExist)
+	_, err = afs.OpenFile("/file.txt", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+
+	file, err := afs.OpenFile("/new.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	assert.NoError(t, err)
+	_, err = file.WriteString("new")
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	got, err := afero.ReadFile(afs, "/new.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(got))
+
+	_, err = afs.Open("/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestVersions(t *testing.T) {
+	clock := gofakes3.FixedTimeSource(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	afs, client := s3FsForTest(t, s3mem.WithTimeSource(clock))
+	_, err := client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket:                  aws.String("bucket"),
+		VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+	})
+	assert.NoError(t, err)
+	put := func(name, contents string) string {
+		clock.Advance(time.Minute)
+		out, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(name),
+			Body:   strings.NewReader(contents),
+		})
+		assert.NoError(t, err)
+		return aws.StringValue(out.VersionId)
+	}
+	del := func(name string) {
+		_, err := client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String(name)})
+		assert.NoError(t, err)
+	}
+	first := put("build.bin", "first")
+	put("build.bin.sig", "signature")
+	put("gone.bin", "gone")
+	put("sub/file.txt", "file")
+	// deleted within the same second as written and written again later
+	put("flapping.bin", "flapping")
+	del("flapping.bin")
+	pinned := clock.Now()
+	second := put("build.bin", "second")
+	put("new.bin", "new")
+	put("flapping.bin", "back")
+	clock.Advance(time.Minute)
+	del("gone.bin")
+
+	read := func(name string) string {
+		got, err := afero.ReadFile(afs, name)
+		assert.NoError(t, err, name)
+		return string(got)
+	}
+	assert.Equal(t, "second", read("/build.bin"))
+	assert.Equal(t, "first", read("/build.bin@"+first))
+	assert.Equal(t, "second", read("/build.bin@"+second))
+	_, err = afs.Stat("/build.bin@nope")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = afs.Stat("/gone.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// open file keeps reading its version
+	file, err := afs.Open("/build.bin")
+	assert.NoError(t, err)
+	head := make([]byte, 3)
+	_, err = io.ReadFull(file, head)
+	assert.NoError(t, err)
+	put("build.bin", "overwritten")
+	rest, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(head)+string(rest))
+	assert.NoError(t, file.Close())
+
+	afs.Pinned = pinned
+	assert.Equal(t, "first", read("/build.bin"))
+	assert.Equal(t, "gone", read("/gone.bin"))
+	assert.Equal(t, "second", read("/build.bin@"+second))
+	_, err = afs.Stat("/new.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = afs.Stat("/flapping.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	info, err := afs.Stat("/sub")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	dir, err := afs.Open("/")
+	assert.NoError(t, err)
+	names, err := dir.Readdirnames(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build.bin", "build.bin.sig", "gone.bin", "sub"}, names)
+	_, err = afs.Create("/build.bin")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+
+	// pinned to a version the rest of the bucket is as of when it was written
+	afs.Pinned = time.Time{}
+	afs.PinnedVersion = first
+	assert.Equal(t, "first", read("/build.bin"))
+	_, err = afs.Stat("/gone.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	dir, err = afs.Open("/")
+	assert.NoError(t, err)
+	names, err = dir.Readdirnames(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build.bin"}, names)
+	_, err = afs.Create("/build.bin")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+
+	missing, _ := s3FsForTest(t)
+	missing.PinnedVersion = "nope"
+	_, err = missing.Stat("/build.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+// multipartUploads lists uploads neither completed nor aborted
+func multipartUploads(t *testing.T, client *s3.S3) []*s3.MultipartUpload {
+	out, err := client.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: aws.String("bucket")})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == "NoSuchUpload" {
+		return nil // fake s3 fails to list a bucket never uploaded to
+	}
+	assert.NoError(t, err)
+	return out.Uploads
+}
+
+// s3FsForTest serves in memory s3 with a bucket returning S3Fs of it
+// and a client to inspect the bucket
+func s3FsForTest(t *testing.T, opts ...s3mem.Option) (*S3Fs, *s3.S3) {
+	fake := gofakes3.New(s3mem.New(opts...)).Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fake s3 ignores version of HEAD, answer it as GET without body
+		if r.Method == http.MethodHead && r.URL.Query().Has("versionId") {
+			r = r.Clone(r.Context())
+			r.Method = http.MethodGet
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	assert.NoError(t, err)
+	client := s3.New(sess)
+	_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("bucket")})
+	assert.NoError(t, err)
+	return NewS3Fs("bucket", sess), client
+}
@@ -0,0 +1,485 @@
+package aferos3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	afero_s3 "github.com/fclairamb/afero-s3"
+	"github.com/spf13/afero"
+)
+
+// VersionSep separates the key and the version id in names of specific versions
+// as in file.bin@<version id>, names of existing keys containing it are read as is
+const VersionSep = "@"
+
+// object is a version of a key names are resolved to
+type object struct {
+	key     string
+	version string // empty for buckets without versioning
+	etag    string
+	size    int64
+	modTime time.Time
+}
+
+// ObjectFile reads the version of the object resolved on open,
+// overwrites of the key during the transfer do not mix into the read
+type ObjectFile struct {
+	fs     *S3Fs
+	name   string
+	obj    *object
+	offset int64
+	body   io.ReadCloser // stream from offset, opened on read
+	closed bool
+}
+
+// pinnedDir is a dir as of the pin
+type pinnedDir struct {
+	name    string
+	entries []os.FileInfo
+	at      int
+	closed  bool
+}
+
+// resolve finds the object version read by name: the one given after VersionSep,
+// the latest as of the pin or the current one
+func (m *S3Fs) resolve(name string) (*object, error) {
+	key := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if key == "" {
+		return nil, fs.ErrNotExist
+	}
+	// version ids may contain slashes
+	if i := strings.LastIndex(key, VersionSep); i > 0 {
+		obj, err := m.head(key[:i], key[i+len(VersionSep):])
+		if !errors.Is(err, fs.ErrNotExist) {
+			return obj, err
+		}
+	}
+	if m.isPinned() {
+		return m.pinned(key)
+	}
+	return m.head(key, "")
+}
+
+// head reads the version of key, the current one if version is empty
+func (m *S3Fs) head(key, version string) (*object, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(m.bucket),
+		Key:    aws.String(key),
+	}
+	if version != "" {
+		input.VersionId = aws.String(version)
+	}
+	out, err := m.client.HeadObject(input)
+	if err != nil {
+		var rf awserr.RequestFailure
+		// malformed version ids are bad requests
+		if errors.As(err, &rf) && (rf.StatusCode() == http.StatusNotFound ||
+			version != "" && rf.StatusCode() == http.StatusBadRequest) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return &object{
+		key:     key,
+		version: aws.StringValue(out.VersionId),
+		etag:    aws.StringValue(out.ETag),
+		size:    aws.Int64Value(out.ContentLength),
+		modTime: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (m *S3Fs) isPinned() bool {
+	return !m.Pinned.IsZero() || m.PinnedVersion != ""
+}
+
+// pinAt returns the time reads are pinned to and the version pinned if any,
+// PinnedVersion is looked up over the bucket once as version ids carry no key
+func (m *S3Fs) pinAt() (time.Time, *object, error) {
+	if m.PinnedVersion == "" {
+		return m.Pinned, nil, nil
+	}
+	m.pinMu.Lock()
+	defer m.pinMu.Unlock()
+	if m.pin != nil {
+		return m.pin.modTime, m.pin, nil
+	}
+	err := m.client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(m.bucket),
+	}, func(out *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, v := range out.Versions {
+			if aws.StringValue(v.VersionId) == m.PinnedVersion {
+				m.pin = &object{
+					key:     aws.StringValue(v.Key),
+					version: aws.StringValue(v.VersionId),
+					etag:    aws.StringValue(v.ETag),
+					size:    aws.Int64Value(v.Size),
+					modTime: aws.TimeValue(v.LastModified),
+				}
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if m.pin == nil {
+		return time.Time{}, nil, fmt.Errorf("pinned version %s: %w", m.PinnedVersion, fs.ErrNotExist)
+	}
+	return m.pin.modTime, m.pin, nil
+}
+
+// pinned finds the version of key current at the pin
+func (m *S3Fs) pinned(key string) (*object, error) {
+	objects, err := m.pinnedObjects(key, true)
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := objects[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return obj, nil
+}
+
+// pinnedObjects lists objects under prefix as of the pin, keys deleted by then
+// are left out, exact lists the prefix key alone stopping at the next key
+func (m *S3Fs) pinnedObjects(prefix string, exact bool) (map[string]*object, error) {
+	at, pin, err := m.pinAt()
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		obj     *object
+		latest  bool
+		deleted bool
+	}
+	latest := make(map[string]candidate)
+	// versions and delete markers are each listed from newer to older, on ties
+	// the first listed is kept and a delete wins over a put it may have deleted
+	newer := func(c, prev candidate) bool {
+		switch {
+		case !c.obj.modTime.Equal(prev.obj.modTime):
+			return c.obj.modTime.After(prev.obj.modTime)
+		case c.latest != prev.latest:
+			return c.latest
+		}
+		return c.deleted && !prev.deleted
+	}
+	consider := func(c candidate) {
+		if c.obj.modTime.After(at) {
+			return
+		}
+		if prev, ok := latest[c.obj.key]; ok && !newer(c, prev) {
+			return
+		}
+		latest[c.obj.key] = c
+	}
+	done := false
+	err = m.client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(m.bucket),
+		Prefix: aws.String(prefix),
+	}, func(out *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, v := range out.Versions {
+			obj := &object{
+				key:     aws.StringValue(v.Key),
+				version: aws.StringValue(v.VersionId),
+				etag:    aws.StringValue(v.ETag),
+				size:    aws.Int64Value(v.Size),
+				modTime: aws.TimeValue(v.LastModified),
+			}
+			// the key is listed first among keys it prefixes
+			if exact && obj.key != prefix {
+				done = true
+				continue
+			}
+			consider(candidate{obj: obj, latest: aws.BoolValue(v.IsLatest)})
+		}
+		for _, d := range out.DeleteMarkers {
+			obj := &object{key: aws.StringValue(d.Key), modTime: aws.TimeValue(d.LastModified)}
+			if exact && obj.key != prefix {
+				done = true
+				continue
+			}
+			consider(candidate{obj: obj, latest: aws.BoolValue(d.IsLatest), deleted: true})
+		}
+		return !done
+	})
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]*object, len(latest))
+	for key, c := range latest {
+		if !c.deleted {
+			objects[key] = c.obj
+		}
+	}
+	// the pinned version is read even if its key was written again within the same second
+	if pin != nil && (exact && pin.key == prefix || !exact && strings.HasPrefix(pin.key, prefix)) {
+		objects[pin.key] = pin
+	}
+	return objects, nil
+}
+
+// pinnedDir lists entries of dir as of the pin, nil if there are none
+func (m *S3Fs) pinnedDir(name string) ([]os.FileInfo, error) {
+	prefix := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	objects, err := m.pinnedObjects(prefix, false)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]os.FileInfo)
+	for key, obj := range objects {
+		child, rest, isDir := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		switch {
+		case child == "":
+		case isDir && rest != "":
+			entries[child] = afero_s3.NewFileInfo(child, true, 0, time.Unix(0, 0))
+		case !isDir:
+			entries[child] = afero_s3.NewFileInfo(child, false, obj.size, obj.modTime)
+		}
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Presign returns url to GET the object version read by name valid for ttl
+func (m *S3Fs) Presign(name string, ttl time.Duration) (string, error) {
+	obj, err := m.resolve(name)
+	if err != nil {
+		return "", &os.PathError{Op: "presign", Path: name, Err: err}
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(m.bucket),
+		Key:    aws.String(obj.key),
+	}
+	if obj.version != "" {
+		input.VersionId = aws.String(obj.version)
+	}
+	req, _ := m.client.GetObjectRequest(input)
+	return req.Presign(ttl)
+}
+
+func (m *ObjectFile) Name() string {
+	return m.name
+}
+
+func (m *ObjectFile) Read(p []byte) (int, error) {
+	if m.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if m.offset >= m.obj.size {
+		return 0, io.EOF
+	}
+	if m.body == nil {
+		body, err := m.get(fmt.Sprintf("bytes=%d-", m.offset))
+		if err != nil {
+			return 0, err
+		}
+		m.body = body
+	}
+	n, err := m.body.Read(p)
+	m.offset += int64(n)
+	if err == io.EOF && m.offset < m.obj.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (m *ObjectFile) ReadAt(p []byte, off int64) (int, error) {
+	if m.closed {
+		return 0, afero.ErrFileClosed
+	}
+	if off >= m.obj.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), m.obj.size)
+	body, err := m.get(fmt.Sprintf("bytes=%d-%d", off, end-1))
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err == nil && end < off+int64(len(p)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// get reads range of the version opened, without versioning the etag
+// guards against reading parts of different objects
+func (m *ObjectFile) get(byteRange string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(m.fs.bucket),
+		Key:    aws.String(m.obj.key),
+		Range:  aws.String(byteRange),
+	}
+	if m.obj.version != "" {
+		input.VersionId = aws.String(m.obj.version)
+	} else if m.obj.etag != "" {
+		input.IfMatch = aws.String(m.obj.etag)
+	}
+	out, err := m.fs.client.GetObject(input)
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: m.name, Err: err}
+	}
+	return out.Body, nil
+}
+
+func (m *ObjectFile) Seek(offset int64, whence int) (int64, error) {
+	if m.closed {
+		return 0, afero.ErrFileClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.obj.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EINVAL}
+	}
+	if offset != m.offset && m.body != nil {
+		m.body.Close()
+		m.body = nil
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *ObjectFile) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	if m.body != nil {
+		return m.body.Close()
+	}
+	return nil
+}
+
+func (m *ObjectFile) Stat() (os.FileInfo, error) {
+	return afero_s3.NewFileInfo(path.Base(m.name), false, m.obj.size, m.obj.modTime), nil
+}
+
+func (m *ObjectFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+}
+
+func (m *ObjectFile) Readdirnames(n int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+}
+
+func (m *ObjectFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *ObjectFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *ObjectFile) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *ObjectFile) Sync() error {
+	return nil
+}
+
+func (m *ObjectFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *pinnedDir) Name() string {
+	return m.name
+}
+
+func (m *pinnedDir) Readdir(count int) ([]os.FileInfo, error) {
+	if m.closed {
+		return nil, afero.ErrFileClosed
+	}
+	rest := m.entries[m.at:]
+	if count <= 0 {
+		m.at = len(m.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	m.at += len(rest)
+	return rest, nil
+}
+
+func (m *pinnedDir) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *pinnedDir) Stat() (os.FileInfo, error) {
+	return afero_s3.NewFileInfo(path.Base(m.name), true, 0, time.Unix(0, 0)), nil
+}
+
+func (m *pinnedDir) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	return nil
+}
+
+func (m *pinnedDir) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+}
+
+func (m *pinnedDir) ReadAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+}
+
+func (m *pinnedDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EISDIR}
+}
+
+func (m *pinnedDir) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *pinnedDir) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *pinnedDir) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+}
+
+func (m *pinnedDir) Sync() error {
+	return nil
+}
+
+func (m *pinnedDir) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EISDIR}
+}
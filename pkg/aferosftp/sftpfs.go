@@ -0,0 +1,344 @@
+package aferosftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+)
+
+// SftpFs is an afero.Fs of sftp server dialed on first use
+// and dialed again once the connection is lost
+type SftpFs struct {
+	dial   func() (*sftp.Client, error)
+	mu     sync.Mutex
+	client *sftp.Client
+	done   chan struct{} // closed once client shuts down
+}
+
+// lostTimeout waits for the connection to shut down after a request failed to be sent
+const lostTimeout = time.Second
+
+// File is a file or a dir open on sftp server
+type File struct {
+	fd      *sftp.File // nil for dirs
+	client  *sftp.Client
+	name    string
+	dir     []os.FileInfo // entries read on first Readdir
+	dirRead bool
+	dirAt   int
+	closed  bool
+}
+
+func NewSftpFs(dial func() (*sftp.Client, error)) *SftpFs {
+	return &SftpFs{dial: dial}
+}
+
+func (m *SftpFs) Name() string {
+	return "SftpFs"
+}
+
+// conn returns the client connected, dialing if there is none,
+// done is closed once the connection shuts down
+func (m *SftpFs) conn() (client *sftp.Client, done chan struct{}, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, m.done, nil
+	}
+	client, err = m.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	done = make(chan struct{})
+	m.client, m.done = client, done
+	go func() {
+		client.Wait()
+		close(done)
+		m.drop(client)
+	}()
+	return client, done, nil
+}
+
+// drop forgets the client so the next operation dials again
+func (m *SftpFs) drop(client *sftp.Client) {
+	m.mu.Lock()
+	if m.client == client {
+		m.client, m.done = nil, nil
+	}
+	m.mu.Unlock()
+	client.Close()
+}
+
+// do runs op on the client retrying once on a new connection
+// if the one it was run on turned out to be lost
+func (m *SftpFs) do(op func(client *sftp.Client) error) error {
+	for retry := false; ; retry = true {
+		client, done, err := m.conn()
+		if err != nil {
+			return err
+		}
+		err = op(client)
+		if retry || !lost(err, done) {
+			return err
+		}
+		m.drop(client)
+	}
+}
+
+// lost reports whether err is caused by the connection shutting down,
+// requests failed to be sent are followed by the shutdown shortly
+func lost(err error, done chan struct{}) bool {
+	var status *sftp.StatusError
+	switch {
+	case err == nil, errors.As(err, &status), errors.Is(err, fs.ErrNotExist),
+		errors.Is(err, fs.ErrPermission), errors.Is(err, fs.ErrExist):
+		return false // answered by the server
+	case errors.Is(err, sftp.ErrSSHFxConnectionLost):
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(lostTimeout):
+		return false
+	}
+}
+
+func (m *SftpFs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (m *SftpFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens dirs for listing only, perm of created files is left to the server
+func (m *SftpFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	var file *File
+	err := m.do(func(client *sftp.Client) error {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+			info, err := client.Stat(name)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				file = &File{client: client, name: name}
+				return nil
+			}
+		}
+		fd, err := client.OpenFile(name, flag)
+		if err != nil {
+			// servers report existing files as a generic failure
+			if _, serr := client.Stat(name); flag&os.O_EXCL != 0 && serr == nil {
+				return fs.ErrExist
+			}
+			return err
+		}
+		file = &File{fd: fd, client: client, name: name}
+		return nil
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+func (m *SftpFs) Mkdir(name string, perm os.FileMode) error {
+	return m.pathErr("mkdir", name, func(client *sftp.Client) error {
+		return client.Mkdir(name)
+	})
+}
+
+func (m *SftpFs) MkdirAll(name string, perm os.FileMode) error {
+	return m.pathErr("mkdir", name, func(client *sftp.Client) error {
+		return client.MkdirAll(name)
+	})
+}
+
+func (m *SftpFs) Remove(name string) error {
+	return m.pathErr("remove", name, func(client *sftp.Client) error {
+		return client.Remove(name)
+	})
+}
+
+func (m *SftpFs) RemoveAll(name string) error {
+	return m.pathErr("remove", name, func(client *sftp.Client) error {
+		err := client.RemoveAll(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (m *SftpFs) Rename(oldname, newname string) error {
+	return m.pathErr("rename", oldname, func(client *sftp.Client) error {
+		if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+			return client.PosixRename(oldname, newname)
+		}
+		return client.Rename(oldname, newname)
+	})
+}
+
+func (m *SftpFs) Stat(name string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := m.pathErr("stat", name, func(client *sftp.Client) (err error) {
+		info, err = client.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+func (m *SftpFs) Chmod(name string, mode os.FileMode) error {
+	return m.pathErr("chmod", name, func(client *sftp.Client) error {
+		return client.Chmod(name, mode)
+	})
+}
+
+func (m *SftpFs) Chown(name string, uid, gid int) error {
+	return m.pathErr("chown", name, func(client *sftp.Client) error {
+		return client.Chown(name, uid, gid)
+	})
+}
+
+func (m *SftpFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return m.pathErr("chtimes", name, func(client *sftp.Client) error {
+		return client.Chtimes(name, atime, mtime)
+	})
+}
+
+func (m *SftpFs) pathErr(op, name string, f func(client *sftp.Client) error) error {
+	if err := m.do(f); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+func (m *File) Close() error {
+	if m.fd != nil {
+		return m.fd.Close()
+	}
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	return nil
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.Read(p)
+}
+
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.ReadAt(p, off)
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.Seek(offset, whence)
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.Write(p)
+}
+
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.WriteAt(p, off)
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return m.Write([]byte(s))
+}
+
+// ReadFrom sends writes of the copy concurrently as sftp clients do
+func (m *File) ReadFrom(r io.Reader) (int64, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.ReadFrom(r)
+}
+
+// WriteTo reads ahead concurrently as sftp clients do
+func (m *File) WriteTo(w io.Writer) (int64, error) {
+	if m.fd == nil {
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.WriteTo(w)
+}
+
+func (m *File) Stat() (os.FileInfo, error) {
+	if m.fd == nil {
+		return m.client.Stat(m.name)
+	}
+	return m.fd.Stat()
+}
+
+// Readdir lists the dir once and returns its entries by count
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	if m.fd != nil {
+		return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+	}
+	if !m.dirRead {
+		dir, err := m.client.ReadDir(m.name)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: m.name, Err: err}
+		}
+		m.dir, m.dirRead = dir, true
+	}
+	rest := m.dir[m.dirAt:]
+	if count <= 0 {
+		m.dirAt = len(m.dir)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	m.dirAt += len(rest)
+	return rest, nil
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *File) Truncate(size int64) error {
+	if m.fd == nil {
+		return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.EISDIR}
+	}
+	return m.fd.Truncate(size)
+}
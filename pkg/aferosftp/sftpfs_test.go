@@ -0,0 +1,86 @@
+package aferosftp
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSftpFs(t *testing.T) {
+	afs, root, _ := sftpFsForTest(t)
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "images/old"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "images/a.bin"), []byte("a contents"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "images/b.bin"), []byte("b contents"), 0644))
+
+	got, err := afero.ReadFile(afs, filepath.Join(root, "images/a.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a contents", string(got))
+	info, err := afs.Stat(filepath.Join(root, "images/b.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), info.Size())
+	_, err = afs.Stat(filepath.Join(root, "missing.bin"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = afs.Open(filepath.Join(root, "missing.bin"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// dirs are read by count until io.EOF
+	dir, err := afs.Open(filepath.Join(root, "images"))
+	assert.NoError(t, err)
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(2)
+		names = append(names, batch...)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, dir.Close())
+	sort.Strings(names)
+	assert.Equal(t, []string{"a.bin", "b.bin", "old"}, names)
+
+	assert.NoError(t, afero.WriteFile(afs, filepath.Join(root, "images/c.bin"), []byte("c contents"), 0644))
+	got, err = os.ReadFile(filepath.Join(root, "images/c.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, "c contents", string(got))
+	_, err = afs.OpenFile(filepath.Join(root, "images/c.bin"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	assert.ErrorIs(t, err, fs.ErrExist)
+}
+
+func TestSftpFsReconnect(t *testing.T) {
+	afs, root, conns := sftpFsForTest(t)
+	_, err := afs.Stat(root)
+	assert.NoError(t, err)
+	assert.Len(t, *conns, 1)
+
+	(*conns)[0].Close()
+	_, err = afs.Stat(root)
+	assert.NoError(t, err)
+	assert.Len(t, *conns, 2)
+}
+
+// sftpFsForTest returns SftpFs of sftp server of temp dir over pipes
+// and the server ends of connections dialed
+func sftpFsForTest(t *testing.T) (*SftpFs, string, *[]net.Conn) {
+	conns := &[]net.Conn{}
+	afs := NewSftpFs(func() (*sftp.Client, error) {
+		client, server := net.Pipe()
+		*conns = append(*conns, server)
+		t.Cleanup(func() { server.Close() })
+		srv, err := sftp.NewServer(server)
+		if err != nil {
+			return nil, err
+		}
+		go srv.Serve()
+		return sftp.NewClientPipe(client, client)
+	})
+	return afs, t.TempDir(), conns
+}
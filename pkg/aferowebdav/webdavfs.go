@@ -0,0 +1,473 @@
+package aferowebdav
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/studio-b12/gowebdav"
+)
+
+// abortedLockTimeout waits for the server to release files of aborted uploads
+const abortedLockTimeout = 5 * time.Second
+
+// WebdavFs is an afero.Fs of a collection on webdav server,
+// files are replaced as a whole and uploaded while written
+type WebdavFs struct {
+	client *gowebdav.Client
+}
+
+// File is read by ranged requests, reads are sequential
+// and seeking anywhere else requests the file from the new offset
+type File struct {
+	fs     *WebdavFs
+	name   string
+	info   *FileInfo
+	r      io.ReadCloser
+	pos    int64 // position of r
+	offset int64 // position to read from
+	dir    []os.FileInfo
+	dirAt  int
+	w      *io.PipeWriter
+	done   chan error // result of the upload
+	failed error      // of the transfer aborting the upload
+	create bool       // the upload creates the file
+	closed bool
+}
+
+// FileInfo of files on the server, ETag of the server is kept
+type FileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	etag    string
+}
+
+// NewWebdavFs connects to the collection at uri, credentials are sent
+// with every request when user is set
+func NewWebdavFs(uri, user, pass string) *WebdavFs {
+	return &WebdavFs{client: gowebdav.NewAuthClient(uri, gowebdav.NewPreemptiveAuth(&basicAuth{user: user, pass: pass}))}
+}
+
+func (m *WebdavFs) Name() string {
+	return "WebdavFs"
+}
+
+func (m *WebdavFs) stat(op, name string) (*FileInfo, error) {
+	info, err := m.client.Stat(clean(name))
+	if err != nil {
+		return nil, pathErr(op, name, err)
+	}
+	return fileInfo(path.Base(clean(name)), info), nil
+}
+
+func (m *WebdavFs) Stat(name string) (os.FileInfo, error) {
+	return m.stat("stat", name)
+}
+
+func (m *WebdavFs) Create(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (m *WebdavFs) Open(name string) (afero.File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile for writing uploads the file till it is closed, existing files
+// are only replaced with O_TRUNC as webdav has no partial updates
+func (m *WebdavFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	info, err := m.stat("open", name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return &File{fs: m, name: name, info: info}, nil
+	}
+	switch {
+	case err != nil && (!errors.Is(err, fs.ErrNotExist) || flag&os.O_CREATE == 0):
+		return nil, err
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err == nil && info.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case err == nil && flag&os.O_TRUNC == 0, flag&os.O_APPEND != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOTSUP}
+	case err != nil:
+		// server would create missing parents
+		if _, err := m.stat("open", path.Dir(clean(name))); err != nil {
+			return nil, err
+		}
+	}
+	r, w := io.Pipe()
+	f := &File{
+		fs:     m,
+		name:   name,
+		info:   &FileInfo{name: path.Base(clean(name)), mode: perm, modTime: time.Now()},
+		w:      w,
+		done:   make(chan error, 1),
+		create: err != nil,
+	}
+	go func() {
+		err := m.client.WriteStreamWithLength(clean(name), r, -1, perm)
+		if err != nil {
+			err = pathErr("write", name, err)
+		}
+		// unblocks writes if the server replied before reading the body
+		r.CloseWithError(errors.Join(err, io.ErrClosedPipe))
+		f.done <- err
+	}()
+	return f, nil
+}
+
+func (m *WebdavFs) Mkdir(name string, perm os.FileMode) error {
+	// creating existing collections succeeds with gowebdav
+	if _, err := m.stat("mkdir", name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.client.Mkdir(clean(name), perm); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	return nil
+}
+
+func (m *WebdavFs) MkdirAll(name string, perm os.FileMode) error {
+	if err := m.client.MkdirAll(clean(name), perm); err != nil {
+		return pathErr("mkdir", name, err)
+	}
+	return nil
+}
+
+// Remove deletes files and empty dirs, removing missing ones succeeds with gowebdav
+func (m *WebdavFs) Remove(name string) error {
+	info, err := m.stat("remove", name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		children, err := m.client.ReadDir(clean(name))
+		if err != nil {
+			return pathErr("remove", name, err)
+		}
+		if len(children) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if err := m.client.Remove(clean(name)); err != nil {
+		return pathErr("remove", name, err)
+	}
+	return nil
+}
+
+func (m *WebdavFs) RemoveAll(name string) error {
+	if err := m.client.RemoveAll(clean(name)); err != nil {
+		return pathErr("remove", name, err)
+	}
+	return nil
+}
+
+func (m *WebdavFs) Rename(oldname, newname string) error {
+	if err := m.client.Rename(clean(oldname), clean(newname), true); err != nil {
+		return pathErr("rename", oldname, err)
+	}
+	return nil
+}
+
+func (m *WebdavFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+func (m *WebdavFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+func (m *WebdavFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+func (m *File) Name() string {
+	return m.name
+}
+
+// Close of written files waits for the upload to finish
+func (m *File) Close() error {
+	if m.closed {
+		return afero.ErrFileClosed
+	}
+	m.closed = true
+	if m.w != nil {
+		m.w.Close()
+		err := <-m.done
+		if m.failed == nil || !m.create {
+			return errors.Join(m.failed, err)
+		}
+		if rerr := m.removeAborted(); rerr != nil {
+			return errors.Join(m.failed, pathErr("remove", m.name, rerr))
+		}
+		return m.failed
+	}
+	if m.r != nil {
+		return m.r.Close()
+	}
+	return nil
+}
+
+// removeAborted removes the file kept of the aborted upload, the server
+// holds it locked until it notices the request body failed
+func (m *File) removeAborted() error {
+	deadline := time.Now().Add(abortedLockTimeout)
+	for {
+		err := m.fs.client.Remove(clean(m.name))
+		switch {
+		case err == nil, gowebdav.IsErrNotFound(err):
+			return nil
+		case !gowebdav.IsErrCode(err, http.StatusLocked), time.Now().After(deadline):
+			return err
+		}
+		time.Sleep(abortedLockTimeout / 100)
+	}
+}
+
+// TransferError aborts the upload rather than completing it with the bytes written so far.
+// Servers such as x/net/webdav keep the bytes they received, so Close removes
+// files the upload created, replaced files are left as the server has them.
+// Files the server creates only after the removal, when the upload is aborted
+// before its first bytes reached the server, are left too
+func (m *File) TransferError(err error) {
+	if m.w != nil {
+		m.failed = err
+		m.w.CloseWithError(err)
+	}
+}
+
+func (m *File) Read(p []byte) (int, error) {
+	switch {
+	case m.w != nil:
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EBADF}
+	case m.info.IsDir():
+		return 0, &os.PathError{Op: "read", Path: m.name, Err: syscall.EISDIR}
+	case m.offset >= m.info.size:
+		return 0, io.EOF
+	}
+	if m.r == nil || m.pos != m.offset {
+		if m.r != nil {
+			m.r.Close()
+		}
+		// length is always set as servers ignoring ranges are read till its end
+		r, err := m.fs.client.ReadStreamRange(clean(m.name), m.offset, m.info.size-m.offset)
+		if err != nil {
+			m.r = nil
+			return 0, pathErr("read", m.name, err)
+		}
+		m.r, m.pos = r, m.offset
+	}
+	n, err := m.r.Read(p[:min(int64(len(p)), m.info.size-m.offset)])
+	m.pos += int64(n)
+	m.offset += int64(n)
+	if err == io.EOF && m.offset < m.info.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && m.offset == m.info.size {
+		err = io.EOF
+	}
+	if err != nil && err != io.EOF {
+		err = &os.PathError{Op: "read", Path: m.name, Err: err}
+	}
+	return n, err
+}
+
+// ReadAt moves the position of sequential reads
+func (m *File) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := m.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(m, p)
+	if err == io.ErrUnexpectedEOF && m.offset >= m.info.size {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (m *File) Seek(offset int64, whence int) (int64, error) {
+	if m.w != nil || m.info.IsDir() {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.ESPIPE}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.offset
+	case io.SeekEnd:
+		offset += m.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: m.name, Err: syscall.EINVAL}
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+// Stat of written files reports the size written so far
+func (m *File) Stat() (os.FileInfo, error) {
+	return m.info, nil
+}
+
+func (m *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !m.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: m.name, Err: syscall.ENOTDIR}
+	}
+	if m.dir == nil {
+		infos, err := m.fs.client.ReadDir(clean(m.name))
+		if err != nil {
+			return nil, pathErr("readdir", m.name, err)
+		}
+		m.dir = make([]os.FileInfo, len(infos))
+		for i, info := range infos {
+			m.dir[i] = fileInfo(info.Name(), info)
+		}
+		sort.Slice(m.dir, func(i, j int) bool { return m.dir[i].Name() < m.dir[j].Name() })
+	}
+	rest := m.dir[m.dirAt:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(count, len(rest))]
+	}
+	m.dirAt += len(rest)
+	return rest, nil
+}
+
+func (m *File) Readdirnames(n int) ([]string, error) {
+	infos, err := m.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (m *File) Write(p []byte) (int, error) {
+	if m.w == nil {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.EBADF}
+	}
+	n, err := m.w.Write(p)
+	m.info.size += int64(n)
+	if err != nil {
+		return n, &os.PathError{Op: "write", Path: m.name, Err: err}
+	}
+	return n, nil
+}
+
+// WriteAt is supported for sequential writes only
+func (m *File) WriteAt(p []byte, off int64) (int, error) {
+	if m.w != nil && off != m.info.size {
+		return 0, &os.PathError{Op: "write", Path: m.name, Err: syscall.ENOTSUP}
+	}
+	return m.Write(p)
+}
+
+func (m *File) WriteString(s string) (int, error) {
+	return m.Write([]byte(s))
+}
+
+func (m *File) Sync() error {
+	return nil
+}
+
+func (m *File) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: m.name, Err: syscall.ENOTSUP}
+}
+
+func (m *FileInfo) Name() string {
+	return m.name
+}
+
+func (m *FileInfo) Size() int64 {
+	return m.size
+}
+
+func (m *FileInfo) Mode() os.FileMode {
+	return m.mode
+}
+
+func (m *FileInfo) ModTime() time.Time {
+	return m.modTime
+}
+
+func (m *FileInfo) IsDir() bool {
+	return m.mode.IsDir()
+}
+
+func (m *FileInfo) Sys() any {
+	return nil
+}
+
+// ETag is the one of the server if it has one
+func (m *FileInfo) ETag() string {
+	return m.etag
+}
+
+// fileInfo names info of the server as the name may be missing in its replies
+func fileInfo(name string, info os.FileInfo) *FileInfo {
+	fi := &FileInfo{name: name, size: info.Size(), mode: 0644, modTime: info.ModTime()}
+	if info.IsDir() {
+		fi.mode = os.ModeDir | 0755
+	}
+	if etager, ok := info.(interface{ ETag() string }); ok {
+		fi.etag = etager.ETag()
+	}
+	return fi
+}
+
+func clean(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// pathErr maps statuses of the server to fs errors
+func pathErr(op, name string, err error) error {
+	var status gowebdav.StatusError
+	if errors.As(err, &status) {
+		switch status.Status {
+		case http.StatusNotFound, http.StatusConflict:
+			err = fs.ErrNotExist
+		case http.StatusUnauthorized, http.StatusForbidden:
+			err = fs.ErrPermission
+		default:
+			err = errors.New(http.StatusText(status.Status))
+		}
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// basicAuth sends credentials with every request, authenticators of gowebdav
+// negotiating the method buffer request bodies to retry them
+type basicAuth struct {
+	user string
+	pass string
+}
+
+func (m *basicAuth) Authorize(c *http.Client, rq *http.Request, path string) error {
+	if m.user != "" {
+		rq.SetBasicAuth(m.user, m.pass)
+	}
+	return nil
+}
+
+func (m *basicAuth) Verify(c *http.Client, rs *http.Response, path string) (bool, error) {
+	return false, nil
+}
+
+func (m *basicAuth) Clone() gowebdav.Authenticator {
+	return m
+}
+
+func (m *basicAuth) Close() error {
+	return nil
+}
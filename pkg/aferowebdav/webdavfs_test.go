@@ -0,0 +1,142 @@
+package aferowebdav
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// serverForTest serves webdav in memory under /dav requiring basic auth
+func serverForTest(t *testing.T) string {
+	dav := &webdav.Handler{Prefix: "/dav", FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "ztp" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/dav"
+}
+
+func TestWebdavFs(t *testing.T) {
+	webdavfs := NewWebdavFs(serverForTest(t), "ztp", "secret")
+	image := strings.Repeat("switch image ", 1000)
+
+	assert.NoError(t, webdavfs.Mkdir("/images", 0755))
+	assert.ErrorIs(t, webdavfs.Mkdir("/images", 0755), fs.ErrExist)
+	assert.ErrorIs(t, webdavfs.Mkdir("/missing/images", 0755), fs.ErrNotExist)
+	assert.NoError(t, afero.WriteFile(webdavfs, "/images/switch.bin", []byte(image), 0644))
+	assert.NoError(t, afero.WriteFile(webdavfs, "/images/empty.bin", nil, 0644))
+	got, err := afero.ReadFile(webdavfs, "/images/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, image, string(got))
+	got, err = afero.ReadFile(webdavfs, "/images/empty.bin")
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+
+	info, err := webdavfs.Stat("/images/switch.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, "switch.bin", info.Name())
+	assert.Equal(t, int64(len(image)), info.Size())
+	assert.NotEmpty(t, info.(*FileInfo).ETag())
+	info, err = webdavfs.Stat("/images")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	_, err = webdavfs.Stat("/images/missing.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	f, err := webdavfs.Open("/images/switch.bin")
+	assert.NoError(t, err)
+	buf := make([]byte, 12)
+	_, err = f.ReadAt(buf, 13*500)
+	assert.NoError(t, err)
+	assert.Equal(t, "switch image", string(buf))
+	_, err = f.ReadAt(buf, 13*10+7)
+	assert.NoError(t, err)
+	assert.Equal(t, "image switch", string(buf))
+	_, err = f.ReadAt(buf, int64(len(image))-6)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NoError(t, f.Close())
+
+	dir, err := webdavfs.Open("/images")
+	assert.NoError(t, err)
+	names := []string{}
+	for {
+		page, err := dir.Readdirnames(1)
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, page...)
+	}
+	assert.Equal(t, []string{"empty.bin", "switch.bin"}, names)
+
+	_, err = webdavfs.OpenFile("/images/switch.bin", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	assert.ErrorIs(t, err, fs.ErrExist)
+	_, err = webdavfs.OpenFile("/images/switch.bin", os.O_WRONLY|os.O_APPEND, 0644)
+	assert.ErrorIs(t, err, syscall.ENOTSUP)
+	_, err = webdavfs.Create("/missing/switch.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, webdavfs.Rename("/images/switch.bin", "/switch.bin"))
+	_, err = webdavfs.Stat("/images/switch.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.ErrorIs(t, webdavfs.Remove("/images"), syscall.ENOTEMPTY)
+	assert.NoError(t, webdavfs.Remove("/images/empty.bin"))
+	assert.ErrorIs(t, webdavfs.Remove("/images/empty.bin"), fs.ErrNotExist)
+	assert.NoError(t, webdavfs.Remove("/images"))
+	assert.NoError(t, webdavfs.MkdirAll("/cfg/sw1", 0755))
+	assert.NoError(t, webdavfs.RemoveAll("/cfg"))
+	_, err = webdavfs.Stat("/cfg")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestWebdavFsAuth(t *testing.T) {
+	webdavfs := NewWebdavFs(serverForTest(t), "ztp", "wrong")
+	_, err := webdavfs.Stat("/")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	err = afero.WriteFile(webdavfs, "/switch.bin", []byte("switch image"), 0644)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+}
+
+func TestWebdavFsTransferError(t *testing.T) {
+	webdavfs := NewWebdavFs(serverForTest(t), "ztp", "secret")
+	image := strings.Repeat("switch image ", 10000)
+	assert.NoError(t, afero.WriteFile(webdavfs, "/switch.bin", []byte(image), 0644))
+
+	// aborted upload of a new file leaves nothing behind
+	f, err := webdavfs.Create("/partial.bin")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(image))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := webdavfs.Stat("/partial.bin")
+		return err == nil
+	}, 5*time.Second, time.Millisecond)
+	f.(*File).TransferError(io.ErrUnexpectedEOF)
+	assert.ErrorIs(t, f.Close(), io.ErrUnexpectedEOF)
+	_, err = webdavfs.Stat("/partial.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// replaced files are not removed
+	f, err = webdavfs.Create("/switch.bin")
+	assert.NoError(t, err)
+	_, err = f.Write([]byte(image))
+	assert.NoError(t, err)
+	f.(*File).TransferError(io.ErrUnexpectedEOF)
+	assert.ErrorIs(t, f.Close(), io.ErrUnexpectedEOF)
+	_, err = webdavfs.Stat("/switch.bin")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,69 @@
+package xtproxy
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/azryve/xtproxy/pkg/aferoarchive"
+	"github.com/spf13/afero"
+)
+
+// archiveURL <format>+<url of the archive>
+// formats: zip, tar (plain or gzip compressed), iso
+// e.g. zip+file:///bundles/nos.zip, tar+s3://endpoint/region/bucket/nos.tar.gz
+type archiveURL struct {
+	URL *url.URL
+}
+
+func (m archiveURL) Fs() (afero.Fs, error) {
+	format, _, ok := strings.Cut(m.URL.Scheme, "+")
+	if !ok {
+		return nil, ErrInvalidURL
+	}
+	fsURL, name, err := splitArchiveURL(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := FsByURL(fsURL.String())
+	if err != nil {
+		return nil, err
+	}
+	return aferoarchive.NewArchiveFs(fs, name, aferoarchive.Format(format))
+}
+
+// BaseScheme is the scheme of the fs of url, archive schemes wrap one
+func BaseScheme(scheme string) string {
+	if _, base, ok := strings.Cut(scheme, "+"); ok {
+		return base
+	}
+	return scheme
+}
+
+// splitArchiveURL splits url of the archive into url of fs containing it
+// and its name in the fs, s3 fs is of the bucket and others of the dir
+func splitArchiveURL(u *url.URL) (*url.URL, string, error) {
+	fsURL := *u
+	fsURL.Scheme = BaseScheme(u.Scheme)
+	name := u.Path
+	if fsURL.Scheme == "file" {
+		name = u.Host + u.Path
+		fsURL.Host = ""
+	}
+	name = path.Clean("/" + name)
+	dir := path.Dir(name)
+	if fsURL.Scheme == "s3" {
+		// region and bucket
+		parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 3)
+		if len(parts) < 3 {
+			return nil, "", fmt.Errorf("url: %s: expected archive in bucket: %w", u.Redacted(), ErrInvalidURL)
+		}
+		dir = "/" + parts[0] + "/" + parts[1]
+	}
+	if name == "/" || dir == name {
+		return nil, "", fmt.Errorf("url: %s: expected archive file: %w", u.Redacted(), ErrInvalidURL)
+	}
+	fsURL.Path, fsURL.RawPath = dir, ""
+	return &fsURL, path.Join("/", strings.TrimPrefix(name, dir)), nil
+}
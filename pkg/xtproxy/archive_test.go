@@ -0,0 +1,103 @@
+package xtproxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArchiveURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		fs   string
+		name string
+	}{
+		{"zip+file:///bundles/nos.zip", "file:///bundles", "/nos.zip"},
+		{"iso+file:///nos.iso", "file:///", "/nos.iso"},
+		{"tar+s3://minio.local/us-east-1/images/vendor/nos.tar.gz?path_style=true", "s3://minio.local/us-east-1/images?path_style=true", "/vendor/nos.tar.gz"},
+		{"tar+https://repo.example.com/vendor/nos.tar", "https://repo.example.com/vendor", "/nos.tar"},
+	}
+	for _, tt := range tests {
+		parsedURL, err := url.Parse(tt.url)
+		assert.NoError(t, err)
+		fsURL, name, err := splitArchiveURL(parsedURL)
+		assert.NoError(t, err, tt.url)
+		assert.Equal(t, tt.fs, fsURL.String(), tt.url)
+		assert.Equal(t, tt.name, name, tt.url)
+	}
+
+	for _, bad := range []string{
+		"zip+file:///",
+		"tar+s3://minio.local/us-east-1/images",
+	} {
+		parsedURL, err := url.Parse(bad)
+		assert.NoError(t, err)
+		_, _, err = splitArchiveURL(parsedURL)
+		assert.ErrorIs(t, err, ErrInvalidURL, bad)
+	}
+
+	_, err := FsByURL("rar+file:///bundles/nos.rar")
+	assert.Error(t, err)
+}
+
+func TestArchiveToHTTP(t *testing.T) {
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	w, err := zw.Create("nos/switch.bin")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("switch image"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "nos.zip"), zipBuf.Bytes(), 0644))
+
+	// tar served over http by another proxy
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "nos/switch.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: 12}))
+	_, err = tw.Write([]byte("switch image"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	basefs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(basefs, "/vendor/nos.tar", tarBuf.Bytes(), 0644))
+	xhttpbase := xtproxyHttpProxyForTest(t, basefs)
+	go xhttpbase.Wait()
+
+	for _, rawURL := range []string{
+		"zip+file://" + dir + "/nos.zip",
+		fmt.Sprintf("tar+http://%s/vendor/nos.tar", xhttpbase.Listener.Addr().String()),
+	} {
+		t.Run(rawURL, func(t *testing.T) {
+			fs, err := FsByURL(rawURL)
+			assert.NoError(t, err)
+			xhttp := xtproxyHttpProxyForTest(t, fs)
+			go xhttp.Wait()
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/nos/switch.bin", xhttp.Listener.Addr().String()), nil)
+			assert.NoError(t, err)
+			req.Header.Set("Range", "bytes=7-")
+			r, err := (&http.Client{}).Do(req)
+			assert.NoError(t, err)
+			defer r.Body.Close()
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+			assert.Equal(t, "image", string(body))
+
+			r, err = http.Get(fmt.Sprintf("http://%s/nos/missing.bin", xhttp.Listener.Addr().String()))
+			assert.NoError(t, err)
+			r.Body.Close()
+			assert.Equal(t, http.StatusNotFound, r.StatusCode)
+		})
+	}
+}
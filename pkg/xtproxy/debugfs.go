@@ -91,6 +91,11 @@ func (m *DebugFs) Create(name string) (f afero.File, err error) {
 	return f, err
 }
 
+func (m *DebugFile) TransferError(err error) {
+	log.Printf("debugfs Open(%s).TransferError(%s)\n", m.Name(), err)
+	transferError(m.File, err)
+}
+
 func (m *DebugFile) Read(p []byte) (n int, err error) {
 	n, err = m.File.Read(p)
 	log.Printf("debugfs Open(%s).Read(p) -> (%d, %s)\n", m.Name(), n, err)
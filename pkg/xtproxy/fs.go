@@ -3,6 +3,7 @@ package xtproxy
 import (
 	"errors"
 	"net/url"
+	"strings"
 
 	"github.com/spf13/afero"
 )
@@ -27,8 +28,24 @@ func FsByURL(rawURL string) (afero.Fs, error) {
 		fs = httpURL{URL}
 	case "https":
 		fs = httpURL{URL}
+	case "sftp":
+		fs = sftpURL{URL}
+	case "oci":
+		fs = ociURL{URL}
+	case "webdav":
+		fs = webdavURL{URL}
+	case "webdavs":
+		fs = webdavURL{URL}
 	default:
-		return nil, errors.New("unknown scheme")
+		wrapper, _, ok := strings.Cut(URL.Scheme, "+")
+		switch {
+		case !ok:
+			return nil, errors.New("unknown scheme")
+		case wrapper == "git":
+			fs = gitURL{URL}
+		default:
+			fs = archiveURL{URL}
+		}
 	}
 	return fs.Fs()
 }
@@ -1,9 +1,13 @@
 package xtproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	ftpserverlib "github.com/fclairamb/ftpserverlib"
 	"github.com/spf13/afero"
@@ -12,18 +16,83 @@ import (
 type XTProxyFTP struct {
 	Fs         afero.Fs
 	ListenAddr *net.TCPAddr
+	Settings   FTPSettings
 	server     *ftpserverlib.FtpServer
+	listening  bool
+	stopped    bool
+	transfers  activity
+	mu         sync.Mutex // guards stopped and clients
+	clients    map[uint32]ftpserverlib.ClientContext
+}
+
+// FTPSettings tune ftp frontend, zero values keep library defaults
+type FTPSettings struct {
+	PassivePortStart int           // first port for passive data connections
+	PassivePortEnd   int           // last port for passive data connections
+	IdleTimeout      time.Duration // disconnect inactive clients
+	Banner           string        // welcome message
+}
+
+// Run serves until ctx is done then cancels all the sessions
+func (m *XTProxyFTP) Run(ctx context.Context) error {
+	return runContext(ctx, m)
 }
 
 func (m *XTProxyFTP) Wait() error {
+	if err := m.listen(); err != nil {
+		return err
+	}
+	return m.server.Serve()
+}
+
+// listen binds the address so errors surface before serving
+func (m *XTProxyFTP) listen() error {
 	if m.server == nil {
 		m.server = ftpserverlib.NewFtpServer(m)
 	}
-	return m.server.ListenAndServe()
+	if m.listening {
+		return nil
+	}
+	if err := m.server.Listen(); err != nil {
+		return err
+	}
+	m.listening = true
+	return nil
+}
+
+// stop closes the listener, connected clients continue their sessions
+func (m *XTProxyFTP) stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.listening || m.stopped {
+		return nil
+	}
+	m.stopped = true
+	return m.server.Stop()
+}
+
+// Shutdown stops accepting clients and waits for active transfers to finish
+// disconnecting all clients after that or once ctx is done
+func (m *XTProxyFTP) Shutdown(ctx context.Context) error {
+	stopErr := m.stop()
+	err := m.transfers.wait(ctx)
+	m.mu.Lock()
+	for _, cc := range m.clients {
+		cc.Close()
+	}
+	m.mu.Unlock()
+	return errors.Join(stopErr, err)
 }
 
 type cdriver struct {
 	afero.Fs
+	transfers *activity
+}
+
+// ftpTransfer marks transfer active until closed
+type ftpTransfer struct {
+	ftpserverlib.FileTransfer
+	done func()
 }
 
 var _ ftpserverlib.MainDriver = &XTProxyFTP{}
@@ -32,23 +101,43 @@ var _ ftpserverlib.ClientDriverExtentionFileTransfer = &cdriver{}
 
 // GetSettings returns some general settings around the server setup
 func (m *XTProxyFTP) GetSettings() (*ftpserverlib.Settings, error) {
-	return &ftpserverlib.Settings{
-		ListenAddr: m.ListenAddr.String(),
-	}, nil
+	settings := &ftpserverlib.Settings{
+		ListenAddr:  m.ListenAddr.String(),
+		IdleTimeout: int(m.Settings.IdleTimeout.Seconds()),
+	}
+	if m.Settings.PassivePortStart > 0 {
+		settings.PassiveTransferPortRange = &ftpserverlib.PortRange{
+			Start: m.Settings.PassivePortStart,
+			End:   m.Settings.PassivePortEnd,
+		}
+	}
+	return settings, nil
 }
 
 // ClientConnected is called to send the very first welcome message
 func (m *XTProxyFTP) ClientConnected(cc ftpserverlib.ClientContext) (string, error) {
+	m.mu.Lock()
+	if m.clients == nil {
+		m.clients = make(map[uint32]ftpserverlib.ClientContext)
+	}
+	m.clients[cc.ID()] = cc
+	m.mu.Unlock()
+	if m.Settings.Banner != "" {
+		return m.Settings.Banner, nil
+	}
 	return "xtproxy ftp server", nil
 }
 
 // ClientDisconnected is called when the user disconnects, even if he never authenticated
 func (m *XTProxyFTP) ClientDisconnected(cc ftpserverlib.ClientContext) {
+	m.mu.Lock()
+	delete(m.clients, cc.ID())
+	m.mu.Unlock()
 }
 
 // AuthUser is called when the user disconnects, even if he never authenticated
 func (m *XTProxyFTP) AuthUser(cc ftpserverlib.ClientContext, user, pass string) (ftpserverlib.ClientDriver, error) {
-	return &cdriver{m.Fs}, nil
+	return &cdriver{Fs: m.Fs, transfers: &m.transfers}, nil
 }
 
 // GetTLSConfig returns a TLS Certificate to use
@@ -63,5 +152,20 @@ func (m *XTProxyFTP) GetTLSConfig() (*tls.Config, error) {
 // os.O_CREATE (upload to new file/truncate)
 // offset is the argument of a previous REST command, if any, or 0
 func (m *cdriver) GetHandle(name string, flags int, offset int64) (ftpserverlib.FileTransfer, error) {
-	return m.Fs.OpenFile(name, flags, os.ModePerm)
+	file, err := m.Fs.OpenFile(name, flags, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	m.transfers.add()
+	return &ftpTransfer{FileTransfer: file, done: sync.OnceFunc(m.transfers.done)}, nil
+}
+
+func (m *ftpTransfer) Close() error {
+	defer m.done()
+	return m.FileTransfer.Close()
+}
+
+// TransferError passes transfer errors to the file if it wants them
+func (m *ftpTransfer) TransferError(err error) {
+	transferError(m.FileTransfer, err)
 }
@@ -0,0 +1,77 @@
+package xtproxy
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/azryve/xtproxy/pkg/aferogit"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/spf13/afero"
+)
+
+// gitURL git+file://<repository dir>[?params], git+https://[user:token@]host/repo[?params]
+// params: ref=<branch|tag|commit> (HEAD by default), poll=<duration>
+// remote repositories are fetched into memory without history, local ones are read in place
+type gitURL struct {
+	URL *url.URL
+}
+
+type gitParams struct {
+	Repo string // dir or url without credentials and params
+	User string
+	Pass string
+	Ref  string
+	Poll time.Duration // check the ref for new commits this often
+}
+
+func (m gitURL) Fs() (afero.Fs, error) {
+	params, err := fsSchemeGitParams(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	if BaseScheme(m.URL.Scheme) == "file" {
+		return aferogit.NewLocalGitFs(params.Repo, params.Ref, params.Poll), nil
+	}
+	var auth transport.AuthMethod
+	if params.User != "" {
+		auth = &githttp.BasicAuth{Username: params.User, Password: params.Pass}
+	}
+	return aferogit.NewRemoteGitFs(params.Repo, auth, params.Ref, params.Poll), nil
+}
+
+func fsSchemeGitParams(u *url.URL) (gitParams, error) {
+	params := gitParams{Ref: "HEAD"}
+	repo := *u
+	repo.Scheme, repo.User, repo.RawQuery = BaseScheme(u.Scheme), nil, ""
+	switch repo.Scheme {
+	case "file":
+		params.Repo = u.Host + u.Path
+	case "http", "https":
+		params.Repo = repo.String()
+		params.User = u.User.Username()
+		params.Pass, _ = u.User.Password()
+	default:
+		return gitParams{}, fmt.Errorf("url: %s: expected git+file or git+https: %w", u.Redacted(), ErrInvalidURL)
+	}
+	if repo.Path == "" || repo.Path == "/" {
+		return gitParams{}, fmt.Errorf("url: %s: expected repository path: %w", u.Redacted(), ErrInvalidURL)
+	}
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "ref":
+			params.Ref = value
+		case "poll":
+			poll, err := time.ParseDuration(value)
+			if err != nil || poll <= 0 {
+				return gitParams{}, fmt.Errorf("url: poll=%s: expected positive duration: %w", value, ErrInvalidURL)
+			}
+			params.Poll = poll
+		default:
+			return gitParams{}, fmt.Errorf("url: %s=%s: unknown parameter: %w", key, value, ErrInvalidURL)
+		}
+	}
+	return params, nil
+}
@@ -1,31 +1,111 @@
 package xtproxy
 
 import (
+	"context"
+	"errors"
+	"io"
 	"io/fs"
 	"log"
 	"mime"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/hairyhenderson/go-fsimpl/httpfs"
+	"github.com/azryve/xtproxy/pkg/aferohttp"
+
 	"github.com/spf13/afero"
 )
 
 type XTProxyHTTP struct {
-	Fs       afero.Fs
-	Listener *net.TCPListener
-	server   *http.Server
+	Fs         afero.Fs
+	Listener   *net.TCPListener // used as is if set
+	ListenAddr *net.TCPAddr     // to create Listener otherwise
+	Settings   HTTPSettings
+	server     *http.Server
+	stopped    atomic.Bool
+}
+
+// HTTPSettings tune http frontend, zero values use defaults
+type HTTPSettings struct {
+	ReadTimeout time.Duration // reading the whole request
+	IdleTimeout time.Duration // keep-alive between requests
+	// clients proxied instead of redirected to presigned urls of RedirectFs mounts
+	RedirectExclude []netip.Prefix
+	// serve webdav methods, fs decides which mounts accept changes
+	WebDAV bool
+}
+
+// Run serves until ctx is done then closes all the connections
+func (m *XTProxyHTTP) Run(ctx context.Context) error {
+	return runContext(ctx, m)
 }
 
 func (m *XTProxyHTTP) Wait() error {
+	if err := m.listen(); err != nil {
+		return err
+	}
+	err := m.server.Serve(m.Listener)
+	if errors.Is(err, http.ErrServerClosed) || m.stopped.Load() {
+		return nil
+	}
+	return err
+}
+
+// listen binds the address so errors surface before serving
+func (m *XTProxyHTTP) listen() error {
+	if err := m.init(); err != nil {
+		return err
+	}
+	if m.Listener != nil {
+		return nil
+	}
+	listener, err := net.ListenTCP("tcp", m.ListenAddr)
+	if err != nil {
+		return err
+	}
+	m.Listener = listener
+	return nil
+}
+
+// stop closes the listener right away and lets active requests finish
+func (m *XTProxyHTTP) stop() error {
+	if m.Listener == nil {
+		return nil
+	}
 	if err := m.init(); err != nil {
 		return err
 	}
-	return m.server.Serve(m.Listener)
+	m.stopped.Store(true)
+	if err := m.Listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for active requests to finish
+// closing the connections left once ctx is done
+func (m *XTProxyHTTP) Shutdown(ctx context.Context) error {
+	if err := m.stop(); err != nil {
+		return err
+	}
+	if m.server == nil {
+		return nil
+	}
+	err := m.server.Shutdown(ctx)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	if err != nil {
+		m.server.Close()
+	}
+	return err
 }
 
 func (m *XTProxyHTTP) init() error {
@@ -35,17 +115,30 @@ func (m *XTProxyHTTP) init() error {
 	httpFs := afero.NewHttpFs(m.Fs)
 	fileServer := http.FileServer(httpFs)
 	mux := http.NewServeMux()
-	mux.Handle("/", LoggingMiddleware(ContentTypeMiddleware(fileServer)))
+	readTimeout := 3 * time.Second
+	if m.Settings.ReadTimeout > 0 {
+		readTimeout = m.Settings.ReadTimeout
+	}
+	handler := ContentTypeMiddleware(fileServer)
+	handler = RedirectMiddleware(m.Fs, m.Settings.RedirectExclude, handler)
+	handler = UploadMiddleware(m.Fs, readTimeout, handler)
+	if m.Settings.WebDAV {
+		handler = WebdavMiddleware(m.Fs, handler)
+	}
+	mux.Handle("/", LoggingMiddleware(handler))
 	m.server = &http.Server{
 		Handler:     mux,
-		ReadTimeout: 3 * time.Second,
+		ReadTimeout: readTimeout,
 		IdleTimeout: 10 * time.Second,
 	}
+	if m.Settings.IdleTimeout > 0 {
+		m.server.IdleTimeout = m.Settings.IdleTimeout
+	}
 	return nil
 }
 
 // ContentTypeMiddleware sets a content type manually
-// preventing trying to seek in case its not supported by underlying fs (another http for example)
+// preventing trying to seek in case its not supported by underlying fs
 func ContentTypeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fileExt := filepath.Ext(r.URL.Path)
@@ -58,6 +151,62 @@ func ContentTypeMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// UploadMiddleware stores bodies of PUT requests to fs passing other requests to next
+// read timeout applies to every read of the body rather than the whole upload
+func UploadMiddleware(fs afero.Fs, readTimeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.Error(w, "can not upload a directory", http.StatusMethodNotAllowed)
+			return
+		}
+		file, err := fs.OpenFile(path.Clean(r.URL.Path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		body := &deadlineReader{r: r.Body, rc: http.NewResponseController(w), timeout: readTimeout}
+		if _, err := io.Copy(file, body); err != nil {
+			transferError(file, err)
+			file.Close()
+			httpError(w, err)
+			return
+		}
+		if err := file.Close(); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+// deadlineReader extends read deadline of the connection before every read
+type deadlineReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (m *deadlineReader) Read(p []byte) (int, error) {
+	m.rc.SetReadDeadline(time.Now().Add(m.timeout))
+	return m.r.Read(p)
+}
+
+// httpError replies with status of fs error as http.FileServer does
+func httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
 // LoggingMiddleware is a middleware that logs the request details
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -87,27 +236,18 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 type httpURL struct {
 	URL *url.URL
 }
 
 func (m httpURL) Fs() (afero.Fs, error) {
-	fs, err := httpfs.New(m.URL)
-	if err != nil {
-		return nil, err
+	if m.URL.Scheme != "http" && m.URL.Scheme != "https" {
+		return nil, ErrInvalidURL
 	}
-	fs = &fsTrimPrefix{fs}
-	afs := &afero.FromIOFS{fs}
-	return afs, nil
-}
-
-// by default httpfs expects non-absolute path
-// and http.FileServer acually adds leading / to path
-// to compensate for it lets trim it
-type fsTrimPrefix struct {
-	fs.FS
-}
-
-func (m *fsTrimPrefix) Open(name string) (fs.File, error) {
-	return m.FS.Open(strings.TrimPrefix(name, "/"))
+	return aferohttp.NewHttpFs(m.URL, nil), nil
 }
@@ -0,0 +1,100 @@
+package xtproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	ftpserverlib "github.com/fclairamb/ftpserverlib"
+)
+
+// runContext serves w until ctx is done, then shuts it down
+// with ctx already done so nothing is left running
+func runContext(ctx context.Context, w waiter) error {
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Shutdown(ctx)
+		case <-served:
+		}
+	}()
+	return w.Wait()
+}
+
+// activity counts active transfers so shutdown can wait for them
+type activity struct {
+	mu     sync.Mutex
+	active int
+	idle   chan struct{} // closed once active drops to zero
+}
+
+func (m *activity) add() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == 0 {
+		m.idle = make(chan struct{})
+	}
+	m.active++
+}
+
+func (m *activity) done() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active--
+	if m.active == 0 {
+		close(m.idle)
+	}
+}
+
+// wait returns once there are no active transfers or ctx is done
+func (m *activity) wait(ctx context.Context) error {
+	m.mu.Lock()
+	if m.active == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	idle := m.idle
+	m.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextReader fails reads once ctx is done to abort a transfer
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (m *contextReader) Read(p []byte) (int, error) {
+	if err := m.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.r.Read(p)
+}
+
+// contextWriter fails writes once ctx is done to abort a transfer
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (m *contextWriter) Write(p []byte) (int, error) {
+	if err := m.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return m.w.Write(p)
+}
+
+// transferError tells the file its transfer failed, so uploads are aborted on close
+// instead of storing partial files
+func transferError(file any, err error) {
+	if fte, ok := file.(ftpserverlib.FileTransferError); ok {
+		fte.TransferError(err)
+	}
+}
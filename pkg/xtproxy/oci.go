@@ -0,0 +1,72 @@
+package xtproxy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/azryve/xtproxy/pkg/aferooci"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/afero"
+)
+
+// ociURL oci://[user:password@]registry/repository[:tag|@digest][?params]
+// params: insecure=<bool> plain http registry
+// without user the credentials of docker config of the keychain are used
+type ociURL struct {
+	URL *url.URL
+}
+
+type ociParams struct {
+	Ref      string
+	User     string
+	Pass     string
+	Insecure bool
+}
+
+func (m ociURL) Fs() (afero.Fs, error) {
+	if m.URL.Scheme != "oci" {
+		return nil, ErrInvalidURL
+	}
+	params, err := fsSchemeOciParams(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	var opts []name.Option
+	if params.Insecure {
+		opts = append(opts, name.Insecure)
+	}
+	ref, err := name.ParseReference(params.Ref, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("url: %w: %w", err, ErrInvalidURL)
+	}
+	auth := remote.WithAuthFromKeychain(authn.DefaultKeychain)
+	if params.User != "" {
+		auth = remote.WithAuth(&authn.Basic{Username: params.User, Password: params.Pass})
+	}
+	return aferooci.NewOciFs(ref, auth), nil
+}
+
+func fsSchemeOciParams(u *url.URL) (ociParams, error) {
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return ociParams{}, fmt.Errorf("url: %s: expected registry and repository: %w", u.Redacted(), ErrInvalidURL)
+	}
+	params := ociParams{Ref: u.Host + u.Path, User: u.User.Username()}
+	params.Pass, _ = u.User.Password()
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "insecure":
+			insecure, err := strconv.ParseBool(value)
+			if err != nil {
+				return ociParams{}, fmt.Errorf("url: insecure=%s: %w", value, ErrInvalidURL)
+			}
+			params.Insecure = insecure
+		default:
+			return ociParams{}, fmt.Errorf("url: %s=%s: unknown parameter: %w", key, value, ErrInvalidURL)
+		}
+	}
+	return params, nil
+}
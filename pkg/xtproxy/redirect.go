@@ -0,0 +1,113 @@
+package xtproxy
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/azryve/xtproxy/pkg/aferodecompress"
+	"github.com/azryve/xtproxy/pkg/aferomount"
+	"github.com/spf13/afero"
+)
+
+// Presigner makes urls granting temporary access to a file
+type Presigner interface {
+	Presign(name string, ttl time.Duration) (string, error)
+}
+
+// RedirectFs lets the http frontend redirect clients to presigned urls of files
+// instead of proxying them, other protocols read Fs as is
+type RedirectFs struct {
+	afero.Fs
+	Presigner Presigner
+	TTL       time.Duration // lifetime of redirect urls
+}
+
+// redirectInfo describes a file served by redirect
+type redirectInfo struct {
+	os.FileInfo
+	fs   *RedirectFs
+	name string
+}
+
+// redirecter is a file info of a file served by redirect
+type redirecter interface {
+	RedirectURL() (string, error)
+}
+
+// Stat marks files for redirect, ones decompressed on read have no url and are proxied
+func (m *RedirectFs) Stat(name string) (os.FileInfo, error) {
+	info, err := m.Fs.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return info, err
+	}
+	if _, ok := info.(*aferodecompress.FileInfo); ok {
+		return info, nil
+	}
+	return &redirectInfo{FileInfo: info, fs: m, name: name}, nil
+}
+
+func (m *redirectInfo) RedirectURL() (string, error) {
+	return m.fs.Presigner.Presign(m.name, m.fs.TTL)
+}
+
+// RedirectMiddleware answers GET of files on RedirectFs mounts with a redirect
+// to presigned url, clients from exclude networks are proxied by next as usual
+func RedirectMiddleware(fs afero.Fs, exclude []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean(r.URL.Path)
+		// presigned urls are valid for GET only
+		if r.Method != http.MethodGet || strings.HasSuffix(r.URL.Path, "/") ||
+			excluded(r.RemoteAddr, exclude) || !mayRedirect(fs, name) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, err := fs.Stat(name)
+		redirect, ok := info.(redirecter)
+		if err != nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		url, err := redirect.RedirectURL()
+		if err != nil {
+			log.Printf("presign %s: %s, proxying\n", name, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, url, http.StatusFound)
+	})
+}
+
+// excluded reports whether remote address is in one of networks
+func excluded(remoteAddr string, networks []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, network := range networks {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayRedirect saves stat of files outside of RedirectFs mounts
+func mayRedirect(fs afero.Fs, name string) bool {
+	mfs, ok := fs.(*aferomount.MountFs)
+	if !ok {
+		return true
+	}
+	for _, layer := range mfs.Lookup(name) {
+		if _, ok := layer.(*RedirectFs); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -1,18 +1,25 @@
 package xtproxy
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	afero_s3 "github.com/fclairamb/afero-s3"
+	"github.com/azryve/xtproxy/pkg/aferos3"
 	"github.com/spf13/afero"
 )
 
-// s3URL s3://<access_key>:<secret>@endpoint/bucket
+// s3URL s3://<access_key>:<secret>@endpoint/region/bucket[?params]
+// params: path_style=<bool>, insecure=<bool>, ca=<pem file>, profile=<name>,
+// credentials_file=<aws credentials file>, version=<mount|RFC 3339 time>, version_id=<id>
+// without access key or credentials file the default aws credential chain is used
 type s3URL struct {
 	URL *url.URL
 }
@@ -24,6 +31,12 @@ type s3Params struct {
 	AccessKey  string
 	Secret     string
 	DisableSSL bool
+	PathStyle  bool   // bucket in path instead of host name as MinIO/Ceph expect
+	CABundle   string // pem file with CA certificates trusted for the endpoint
+	Profile    string // shared config profile used without access key
+	CredsFile  string // credentials file of the mount in place of the default chain
+	Version    string // pin reads to versions current at mount or the given time
+	VersionID  string // pin reads to the version and objects current when it was written
 }
 
 func (m s3URL) Fs() (afero.Fs, error) {
@@ -34,19 +47,56 @@ func (m s3URL) Fs() (afero.Fs, error) {
 	if err != nil {
 		return nil, err
 	}
-	sess, err := session.NewSession(&aws.Config{
-		Endpoint: &params.Endpoint,
-		Region:   &params.Region,
-		Credentials: credentials.NewStaticCredentials(
+	sess, err := s3Session(params)
+	if err != nil {
+		return nil, err
+	}
+	fs := aferos3.NewS3Fs(params.Bucket, sess)
+	switch params.Version {
+	case "":
+	case "mount":
+		fs.Pinned = time.Now()
+	default:
+		fs.Pinned, _ = time.Parse(time.RFC3339, params.Version)
+	}
+	fs.PinnedVersion = params.VersionID
+	return fs, nil
+}
+
+// s3Session takes credentials from access key, credentials file or the default chain
+// of env, shared config, web identity token file and ecs or ec2 metadata endpoints
+func s3Session(params s3Params) (*session.Session, error) {
+	opts := session.Options{
+		Config: aws.Config{
+			Endpoint:         &params.Endpoint,
+			Region:           &params.Region,
+			DisableSSL:       aws.Bool(params.DisableSSL),
+			S3ForcePathStyle: aws.Bool(params.PathStyle),
+		},
+		Profile:           params.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	switch {
+	case params.AccessKey != "":
+		opts.Config.Credentials = credentials.NewStaticCredentials(
 			params.AccessKey,
 			params.Secret,
 			"",
-		),
-	})
-	if err != nil {
-		return nil, err
+		)
+	case params.CredsFile != "":
+		// profile is looked up in the file only, not in the shared config
+		opts.Config.Credentials = credentials.NewSharedCredentials(params.CredsFile, params.Profile)
+		opts.Profile = ""
+	}
+	if params.CABundle != "" {
+		ca, err := os.Open(params.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		defer ca.Close()
+		opts.CustomCABundle = ca
 	}
-	return afero_s3.NewFs(params.Bucket, sess), nil
+	return session.NewSessionWithOptions(opts)
 }
 
 func fsSchemeS3Params(u *url.URL) (s3Params, error) {
@@ -55,11 +105,46 @@ func fsSchemeS3Params(u *url.URL) (s3Params, error) {
 	if len(parts) != 2 {
 		return s3Params{}, fmt.Errorf("url: %s: %w", u.Path, ErrInvalidURL)
 	}
-	return s3Params{
+	params := s3Params{
 		Endpoint:  u.Host,
 		Region:    parts[0],
 		Bucket:    parts[1],
 		AccessKey: u.User.Username(),
 		Secret:    secret,
-	}, nil
+	}
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		var err error
+		switch key {
+		case "path_style":
+			params.PathStyle, err = strconv.ParseBool(value)
+		case "insecure":
+			params.DisableSSL, err = strconv.ParseBool(value)
+		case "ca":
+			params.CABundle = value
+		case "profile":
+			params.Profile = value
+		case "credentials_file":
+			params.CredsFile = value
+		case "version":
+			params.Version = value
+			if value != "mount" {
+				_, err = time.Parse(time.RFC3339, value)
+			}
+		case "version_id":
+			params.VersionID = value
+			if value == "" {
+				err = errors.New("empty version id")
+			}
+		default:
+			err = errors.New("unknown parameter")
+		}
+		if err != nil {
+			return s3Params{}, fmt.Errorf("url: %s=%s: %w: %w", key, value, err, ErrInvalidURL)
+		}
+	}
+	if params.Version != "" && params.VersionID != "" {
+		return s3Params{}, fmt.Errorf("url: version and version_id: %w", ErrInvalidURL)
+	}
+	return params, nil
 }
@@ -1,9 +1,28 @@
 package xtproxy
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/azryve/xtproxy/pkg/aferomount"
+	"github.com/jlaffaye/ftp"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/pin/tftp/v3"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,4 +43,326 @@ func TestS3Params(t *testing.T) {
 	if expected != got {
 		t.Fatalf("expected '%v', got '%v'", expected, got)
 	}
+
+	// query parameters
+	s3URL = "s3://minio.example.com:9000/us-east-1/bucket-name?path_style=true&insecure=1&ca=/etc/ssl/minio.pem&profile=x&version=mount"
+	parsedURL, err = url.Parse(s3URL)
+	assert.NoError(t, err)
+	expected = s3Params{
+		Endpoint:   "minio.example.com:9000",
+		Bucket:     "bucket-name",
+		Region:     "us-east-1",
+		DisableSSL: true,
+		PathStyle:  true,
+		CABundle:   "/etc/ssl/minio.pem",
+		Profile:    "x",
+		Version:    "mount",
+	}
+	got, err = fsSchemeS3Params(parsedURL)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, got)
+
+	parsedURL, err = url.Parse("s3://s3-api.example.com/region-name/bucket-name?version_id=3HL4kqtJlcpXroDTDmJ%2Brm")
+	assert.NoError(t, err)
+	got, err = fsSchemeS3Params(parsedURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "3HL4kqtJlcpXroDTDmJ+rm", got.VersionID)
+
+	for _, bad := range []string{
+		"s3://s3-api.example.com/region-name/bucket-name?path_style=maybe",
+		"s3://s3-api.example.com/region-name/bucket-name?pathstyle=true",
+		"s3://s3-api.example.com/region-name/bucket-name?version=yesterday",
+		"s3://s3-api.example.com/region-name/bucket-name?version_id=",
+		"s3://s3-api.example.com/region-name/bucket-name?version=mount&version_id=3HL4kqtJlcpXroDTDmJ",
+	} {
+		parsedURL, err = url.Parse(bad)
+		assert.NoError(t, err)
+		_, err = fsSchemeS3Params(parsedURL)
+		assert.ErrorIs(t, err, ErrInvalidURL, bad)
+	}
+}
+
+func TestS3Credentials(t *testing.T) {
+	// isolate from credentials of the host
+	dir := t.TempDir()
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	ecs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"AccessKeyId":"ecs-access","SecretAccessKey":"ecs-secret","Token":"token","Expiration":"2100-01-01T00:00:00Z"}`))
+	}))
+	defer ecs.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", ecs.URL)
+
+	credsFile := filepath.Join(dir, "account-b")
+	assert.NoError(t, os.WriteFile(credsFile, []byte(`[default]
+aws_access_key_id = file-default
+aws_secret_access_key = secret
+[reader]
+aws_access_key_id = file-reader
+aws_secret_access_key = secret
+`), 0600))
+
+	tests := []struct {
+		name      string
+		url       string
+		accessKey string
+	}{
+		{"static", "s3://access:secret@s3.example.com/region/bucket", "access"},
+		{"credentials file", "s3://s3.example.com/region/bucket?credentials_file=" + credsFile, "file-default"},
+		{"credentials file profile", "s3://s3.example.com/region/bucket?profile=reader&credentials_file=" + credsFile, "file-reader"},
+		{"default chain", "s3://s3.example.com/region/bucket", "ecs-access"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedURL, err := url.Parse(tt.url)
+			assert.NoError(t, err)
+			params, err := fsSchemeS3Params(parsedURL)
+			assert.NoError(t, err)
+			sess, err := s3Session(params)
+			assert.NoError(t, err)
+			creds, err := sess.Config.Credentials.Get()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.accessKey, creds.AccessKeyID)
+		})
+	}
+
+	t.Run("default chain env", func(t *testing.T) {
+		t.Setenv("AWS_ACCESS_KEY_ID", "env-access")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+		sess, err := s3Session(s3Params{Endpoint: "s3.example.com", Region: "region", Bucket: "bucket"})
+		assert.NoError(t, err)
+		creds, err := sess.Config.Credentials.Get()
+		assert.NoError(t, err)
+		assert.Equal(t, "env-access", creds.AccessKeyID)
+	})
+}
+
+func TestS3Upload(t *testing.T) {
+	backend := s3mem.New()
+	assert.NoError(t, backend.CreateBucket("bucket"))
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	defer server.Close()
+	s3fs, err := FsByURL(fmt.Sprintf("s3://access:secret@%s/us-east-1/bucket?path_style=true&insecure=true", server.Listener.Addr()))
+	assert.NoError(t, err)
+	rootfs := aferomount.NewMountFS(afero.NewMemMapFs())
+	assert.NoError(t, rootfs.MountWithOptions(s3fs, "/uploads", aferomount.MountOptions{}))
+	assert.NoError(t, rootfs.MountWithOptions(afero.NewMemMapFs(), "/ro", aferomount.MountOptions{ReadOnly: true}))
+	contents := strings.Repeat("0123456789", 1000)
+	assertUploaded := func(t *testing.T, name string) {
+		got, err := afero.ReadFile(s3fs, name)
+		assert.NoError(t, err)
+		assert.Equal(t, contents, string(got))
+	}
+
+	t.Run("http", func(t *testing.T) {
+		xhttp := xtproxyHttpProxyForTest(t, rootfs)
+		go xhttp.Wait()
+		defer xhttp.Shutdown(context.Background())
+		addr := xhttp.Listener.Addr().String()
+		put := func(name string) int {
+			req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://%s%s", addr, name), strings.NewReader(contents))
+			assert.NoError(t, err)
+			r, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			r.Body.Close()
+			return r.StatusCode
+		}
+		assert.Equal(t, http.StatusCreated, put("/uploads/http.txt"))
+		assertUploaded(t, "/http.txt")
+		assert.Equal(t, http.StatusForbidden, put("/ro/http.txt"))
+
+		// client disconnecting in the middle of the body
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		fmt.Fprintf(conn, "PUT /uploads/partial.txt HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n", addr, len(contents))
+		io.WriteString(conn, contents[:100])
+		conn.(*net.TCPConn).CloseWrite()
+		r, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, r.StatusCode)
+		conn.Close()
+		_, err = s3fs.Stat("/partial.txt")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("ftp", func(t *testing.T) {
+		xftp := &XTProxyFTP{Fs: rootfs, ListenAddr: freeTCPAddrForTest(t)}
+		assert.NoError(t, xftp.listen())
+		go xftp.Wait()
+		defer xftp.Shutdown(context.Background())
+		c, err := ftp.Dial(xftp.ListenAddr.String(), ftp.DialWithTimeout(5*time.Second))
+		assert.NoError(t, err)
+		defer c.Quit()
+		assert.NoError(t, c.Login("anonymous", "anonymous"))
+		assert.NoError(t, c.Stor("/uploads/ftp.txt", strings.NewReader(contents)))
+		assertUploaded(t, "/ftp.txt")
+	})
+
+	t.Run("tftp", func(t *testing.T) {
+		xtftp := &XTProxyTFTP{Fs: rootfs, ListenAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+		assert.NoError(t, xtftp.listen())
+		go xtftp.Wait()
+		defer xtftp.Shutdown(context.Background())
+		c, err := tftp.NewClient(xtftp.conn.LocalAddr().String())
+		assert.NoError(t, err)
+		rf, err := c.Send("/uploads/tftp.txt", "octet")
+		assert.NoError(t, err)
+		_, err = rf.ReadFrom(strings.NewReader(contents))
+		assert.NoError(t, err)
+		// transfer completes on server once the last ack is sent
+		assert.Eventually(t, func() bool {
+			_, err := s3fs.Stat("/tftp.txt")
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		assertUploaded(t, "/tftp.txt")
+	})
+}
+
+func TestS3Redirect(t *testing.T) {
+	backend := s3mem.New()
+	assert.NoError(t, backend.CreateBucket("bucket"))
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	defer server.Close()
+	s3fs, err := FsByURL(fmt.Sprintf("s3://access:secret@%s/us-east-1/bucket?path_style=true&insecure=true", server.Listener.Addr()))
+	assert.NoError(t, err)
+	assert.NoError(t, afero.WriteFile(s3fs, "/file.bin", []byte("file contents"), 0644))
+	localfs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(localfs, "/file.bin", []byte("local contents"), 0644))
+	rootfs := aferomount.NewMountFS(afero.NewMemMapFs())
+	redirectfs := &RedirectFs{Fs: s3fs, Presigner: s3fs.(Presigner), TTL: time.Minute}
+	assert.NoError(t, rootfs.Mount(redirectfs, "/s3"))
+	assert.NoError(t, rootfs.Mount(localfs, "/local"))
+
+	noFollow := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(t *testing.T, method, url string) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+		r, err := noFollow.Do(req)
+		assert.NoError(t, err)
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		return r, string(body)
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		xhttp := xtproxyHttpProxyForTest(t, rootfs)
+		go xhttp.Wait()
+		defer xhttp.Shutdown(context.Background())
+		base := "http://" + xhttp.Listener.Addr().String()
+
+		r, _ := get(t, http.MethodGet, base+"/s3/file.bin")
+		assert.Equal(t, http.StatusFound, r.StatusCode)
+		location, err := url.Parse(r.Header.Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, server.Listener.Addr().String(), location.Host)
+		assert.Equal(t, "60", location.Query().Get("X-Amz-Expires"))
+		r, body := get(t, http.MethodGet, location.String())
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "file contents", body)
+
+		// presigned url is for GET only
+		r, _ = get(t, http.MethodHead, base+"/s3/file.bin")
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		// other mounts and missing files are proxied
+		r, body = get(t, http.MethodGet, base+"/local/file.bin")
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "local contents", body)
+		r, _ = get(t, http.MethodGet, base+"/s3/missing.bin")
+		assert.Equal(t, http.StatusNotFound, r.StatusCode)
+	})
+
+	t.Run("excluded", func(t *testing.T) {
+		xhttp := xtproxyHttpProxyForTest(t, rootfs)
+		xhttp.Settings.RedirectExclude = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+		go xhttp.Wait()
+		defer xhttp.Shutdown(context.Background())
+		r, body := get(t, http.MethodGet, "http://"+xhttp.Listener.Addr().String()+"/s3/file.bin")
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "file contents", body)
+	})
+}
+
+func TestS3Versions(t *testing.T) {
+	clock := gofakes3.FixedTimeSource(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	backend := s3mem.New(s3mem.WithTimeSource(clock))
+	assert.NoError(t, backend.CreateBucket("bucket"))
+	assert.NoError(t, backend.SetVersioningConfiguration("bucket", gofakes3.VersioningConfiguration{Status: gofakes3.VersioningEnabled}))
+	fake := gofakes3.New(backend).Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fake s3 ignores version of HEAD, answer it as GET without body
+		if r.Method == http.MethodHead && r.URL.Query().Has("versionId") {
+			r = r.Clone(r.Context())
+			r.Method = http.MethodGet
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	put := func(contents string) string {
+		clock.Advance(time.Minute)
+		result, err := backend.PutObject("bucket", "build.bin", nil, strings.NewReader(contents), int64(len(contents)))
+		assert.NoError(t, err)
+		return string(result.VersionID)
+	}
+	first := put("first")
+	pinned := clock.Now().Format(time.RFC3339)
+	put("second")
+
+	s3URL := fmt.Sprintf("s3://access:secret@%s/us-east-1/bucket?path_style=true&insecure=true", server.Listener.Addr())
+	latestfs, err := FsByURL(s3URL)
+	assert.NoError(t, err)
+	pinnedfs, err := FsByURL(s3URL + "&version=" + pinned)
+	assert.NoError(t, err)
+	byIDfs, err := FsByURL(s3URL + "&version_id=" + url.QueryEscape(first))
+	assert.NoError(t, err)
+	rootfs := aferomount.NewMountFS(afero.NewMemMapFs())
+	assert.NoError(t, rootfs.Mount(latestfs, "/latest"))
+	assert.NoError(t, rootfs.Mount(pinnedfs, "/pinned"))
+	assert.NoError(t, rootfs.Mount(byIDfs, "/byid"))
+
+	t.Run("http", func(t *testing.T) {
+		xhttp := xtproxyHttpProxyForTest(t, rootfs)
+		go xhttp.Wait()
+		defer xhttp.Shutdown(context.Background())
+		get := func(name string) string {
+			r, err := http.Get(fmt.Sprintf("http://%s%s", xhttp.Listener.Addr(), name))
+			assert.NoError(t, err)
+			defer r.Body.Close()
+			assert.Equal(t, http.StatusOK, r.StatusCode, name)
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			return string(body)
+		}
+		assert.Equal(t, "second", get("/latest/build.bin"))
+		assert.Equal(t, "first", get("/latest/build.bin@"+first))
+		assert.Equal(t, "first", get("/pinned/build.bin"))
+		assert.Equal(t, "first", get("/byid/build.bin"))
+	})
+
+	t.Run("ftp", func(t *testing.T) {
+		xftp := &XTProxyFTP{Fs: rootfs, ListenAddr: freeTCPAddrForTest(t)}
+		assert.NoError(t, xftp.listen())
+		go xftp.Wait()
+		defer xftp.Shutdown(context.Background())
+		c, err := ftp.Dial(xftp.ListenAddr.String(), ftp.DialWithTimeout(5*time.Second))
+		assert.NoError(t, err)
+		defer c.Quit()
+		assert.NoError(t, c.Login("anonymous", "anonymous"))
+		retr := func(name string) string {
+			r, err := c.Retr(name)
+			assert.NoError(t, err, name)
+			defer r.Close()
+			body, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			return string(body)
+		}
+		assert.Equal(t, "first", retr("/latest/build.bin@"+first))
+		assert.Equal(t, "first", retr("/pinned/build.bin"))
+	})
 }
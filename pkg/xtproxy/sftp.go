@@ -0,0 +1,206 @@
+package xtproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/azryve/xtproxy/pkg/aferosftp"
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDialTimeout limits connecting and ssh handshake
+const sftpDialTimeout = 10 * time.Second
+
+// sftpKeepalive is the interval of keepalive requests closing connections
+// the server stopped answering, so the next operation dials again
+const sftpKeepalive = 30 * time.Second
+
+// sftpURL sftp://[user@]host[:port]/path[?params]
+// params: key=<private key file>, agent=<ssh-agent socket>, known_hosts=<file>
+// without key or agent the ssh-agent of SSH_AUTH_SOCK is used,
+// host keys are verified against ~/.ssh/known_hosts by default
+type sftpURL struct {
+	URL *url.URL
+}
+
+type sftpParams struct {
+	Addr       string
+	User       string
+	Path       string
+	KeyFile    string // unencrypted private key, encrypted ones are used with ssh-agent
+	Agent      string // ssh-agent socket
+	KnownHosts string
+}
+
+func (m sftpURL) Fs() (afero.Fs, error) {
+	if m.URL.Scheme != "sftp" {
+		return nil, ErrInvalidURL
+	}
+	params, err := fsSchemeSftpParams(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if params.KeyFile != "" {
+		pem, err := os.ReadFile(params.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", params.KeyFile, err)
+		}
+	}
+	hostKeys, err := knownhosts.New(params.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+	fs := aferosftp.NewSftpFs(func() (*sftp.Client, error) {
+		return sftpDial(params, signer, hostKeys)
+	})
+	return afero.NewBasePathFs(fs, params.Path), nil
+}
+
+// sftpDial connects to the server authenticating with the key and the keys of ssh-agent
+func sftpDial(params sftpParams, signer ssh.Signer, hostKeys ssh.HostKeyCallback) (*sftp.Client, error) {
+	config := &ssh.ClientConfig{
+		User:              params.User,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeys, params.Addr),
+		Timeout:           sftpDialTimeout,
+	}
+	if signer != nil {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if params.Agent != "" {
+		agentConn, err := net.Dial("unix", params.Agent)
+		if err != nil {
+			return nil, fmt.Errorf("ssh-agent: %w", err)
+		}
+		defer agentConn.Close()
+		config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+	}
+	conn, err := ssh.Dial("tcp", params.Addr, config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go sftpKeepaliveLoop(conn, client)
+	return client, nil
+}
+
+// sftpKeepaliveLoop closes the connection once the server stops answering
+// or the sftp session ends
+func sftpKeepaliveLoop(conn *ssh.Client, client *sftp.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	defer conn.Close()
+	ticker := time.NewTicker(sftpKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			timer := time.AfterFunc(sftpKeepalive, func() { conn.Close() })
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			timer.Stop()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// hostKeyAlgorithms lists types of keys known hosts has for addr,
+// the server offering a key of other type first would fail the verification
+func hostKeyAlgorithms(hostKeys ssh.HostKeyCallback, addr string) []string {
+	var keyErr *knownhosts.KeyError
+	err := hostKeys(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownKey{})
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// unknownKey matches no known key to list the known ones
+type unknownKey struct{}
+
+func (unknownKey) Type() string                        { return "unknown" }
+func (unknownKey) Marshal() []byte                     { return []byte("unknown") }
+func (unknownKey) Verify([]byte, *ssh.Signature) error { return errors.New("unknown key") }
+
+func fsSchemeSftpParams(u *url.URL) (sftpParams, error) {
+	if u.Host == "" || u.Path == "" {
+		return sftpParams{}, fmt.Errorf("url: %s: %w", u.Redacted(), ErrInvalidURL)
+	}
+	if _, ok := u.User.Password(); ok {
+		return sftpParams{}, fmt.Errorf("url: password auth is not supported use key or agent: %w", ErrInvalidURL)
+	}
+	params := sftpParams{
+		Addr:  u.Host,
+		User:  u.User.Username(),
+		Path:  u.Path,
+		Agent: os.Getenv("SSH_AUTH_SOCK"),
+	}
+	if u.Port() == "" {
+		params.Addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if params.User == "" {
+		current, err := user.Current()
+		if err != nil {
+			return sftpParams{}, fmt.Errorf("url: no user: %w: %w", err, ErrInvalidURL)
+		}
+		params.User = current.Username
+	}
+	home, _ := os.UserHomeDir()
+	params.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	query := u.Query()
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "key":
+			params.KeyFile = value
+		case "agent":
+			params.Agent = value
+		case "known_hosts":
+			params.KnownHosts = value
+		default:
+			return sftpParams{}, fmt.Errorf("url: %s=%s: unknown parameter: %w", key, value, ErrInvalidURL)
+		}
+	}
+	// key given alone is not mixed with keys of the agent of the environment
+	if query.Has("key") && !query.Has("agent") {
+		params.Agent = ""
+	}
+	if params.KeyFile == "" && params.Agent == "" {
+		return sftpParams{}, fmt.Errorf("url: expected key or ssh-agent: %w", ErrInvalidURL)
+	}
+	return params, nil
+}
@@ -1,25 +1,93 @@
 package xtproxy
 
 import (
+	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"net"
 	"os"
+	"time"
 
-	"github.com/pin/tftp"
+	"github.com/pin/tftp/v3"
 	"github.com/spf13/afero"
 )
 
 type XTProxyTFTP struct {
 	Fs         afero.Fs
 	ListenAddr *net.UDPAddr
+	Settings   TFTPSettings
 	server     *tftp.Server
+	conn       *net.UDPConn
+	ctx        context.Context // cancelled to abort transfers
+	cancel     context.CancelFunc
+}
+
+// TFTPSettings tune tftp frontend, zero values keep library defaults
+type TFTPSettings struct {
+	Timeout time.Duration // wait for a single packet round-trip
+	Retries int           // attempts to transmit a packet
+}
+
+// Run serves until ctx is done then aborts all the transfers
+func (m *XTProxyTFTP) Run(ctx context.Context) error {
+	return runContext(ctx, m)
 }
 
 func (m *XTProxyTFTP) Wait() error {
+	if err := m.listen(); err != nil {
+		return err
+	}
+	return m.server.Serve(m.conn)
+}
+
+// listen binds the address so errors surface before serving
+func (m *XTProxyTFTP) listen() error {
 	if err := m.init(); err != nil {
 		return err
 	}
-	return m.server.ListenAndServe(m.ListenAddr.String())
+	if m.conn != nil {
+		return nil
+	}
+	conn, err := net.ListenUDP("udp", m.ListenAddr)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	return nil
+}
+
+// stop closes the listening socket right away and lets transfers finish
+func (m *XTProxyTFTP) stop() error {
+	if m.conn == nil {
+		return nil
+	}
+	if err := m.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for active transfers to finish
+// aborting the ones left once ctx is done
+func (m *XTProxyTFTP) Shutdown(ctx context.Context) error {
+	if err := m.init(); err != nil {
+		return err
+	}
+	stopErr := m.stop()
+	done := make(chan struct{})
+	go func() {
+		m.server.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return stopErr
+	case <-ctx.Done():
+		m.cancel()
+		<-done
+		return errors.Join(stopErr, ctx.Err())
+	}
 }
 
 func (m *XTProxyTFTP) init() error {
@@ -30,6 +98,9 @@ func (m *XTProxyTFTP) init() error {
 		m.readHandler,
 		m.writeHandler,
 	)
+	m.server.SetTimeout(m.Settings.Timeout)
+	m.server.SetRetries(m.Settings.Retries)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
 	return nil
 }
 
@@ -38,9 +109,16 @@ func (m *XTProxyTFTP) readHandler(filename string, rf io.ReaderFrom) error {
 	fs := m.Fs
 	file, err := fs.Open(filename)
 	if err != nil {
-		return err
+		return tftpError{err}
+	}
+	defer file.Close()
+	// reader wrapped for cancellation hides Seek, so pass tsize explicitly
+	if stat, err := file.Stat(); err == nil {
+		if ot, ok := rf.(tftp.OutgoingTransfer); ok {
+			ot.SetSize(stat.Size())
+		}
 	}
-	_, err = rf.ReadFrom(file)
+	_, err = rf.ReadFrom(&tftpErrorReader{&contextReader{ctx: m.ctx, r: file}})
 	if err != nil {
 		return err
 	}
@@ -52,11 +130,60 @@ func (m *XTProxyTFTP) writeHandler(filename string, wt io.WriterTo) error {
 	fs := m.Fs
 	file, err := fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		return err
+		return tftpError{err}
 	}
-	_, err = wt.WriteTo(file)
+	defer file.Close()
+	_, err = wt.WriteTo(&tftpErrorWriter{&contextWriter{ctx: m.ctx, w: file}})
 	if err != nil {
+		transferError(file, err)
 		return err
 	}
 	return nil
 }
+
+// tftpError keeps backend details such as upstream urls off the wire,
+// pin/tftp sends every error with code 1 and the error text
+// so the text is the fixed message of the RFC 1350 error instead
+type tftpError struct {
+	err error
+}
+
+func (m tftpError) Unwrap() error { return m.err }
+
+func (m tftpError) Error() string {
+	switch {
+	case errors.Is(m.err, fs.ErrNotExist):
+		return "File not found"
+	case errors.Is(m.err, fs.ErrPermission):
+		return "Access violation"
+	case errors.Is(m.err, fs.ErrExist):
+		return "File already exists"
+	}
+	return "Transfer failed"
+}
+
+// tftpErrorReader hides backend read errors aborting a download
+type tftpErrorReader struct {
+	r io.Reader
+}
+
+func (m *tftpErrorReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = tftpError{err}
+	}
+	return n, err
+}
+
+// tftpErrorWriter hides backend write errors aborting an upload
+type tftpErrorWriter struct {
+	w io.Writer
+}
+
+func (m *tftpErrorWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	if err != nil {
+		err = tftpError{err}
+	}
+	return n, err
+}
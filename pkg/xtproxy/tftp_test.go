@@ -0,0 +1,125 @@
+package xtproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTFTPErrors(t *testing.T) {
+	basefs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(basefs, "switch.bin", []byte("switch image"), 0644))
+	assert.NoError(t, afero.WriteFile(basefs, "flaky.bin", bytes.Repeat([]byte("x"), 2048), 0644))
+	xtftp := &XTProxyTFTP{Fs: &brokenFs{Fs: basefs}, ListenAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	assert.NoError(t, xtftp.listen())
+	go xtftp.Wait()
+	defer xtftp.Shutdown(context.Background())
+	server := xtftp.conn.LocalAddr().(*net.UDPAddr)
+
+	// pin/tftp sends code 1 for every error, the message tells them apart
+	tests := []struct {
+		op   uint16
+		name string
+		msg  string
+	}{
+		{1, "missing.bin", "File not found"},
+		{1, "forbidden.bin", "Access violation"},
+		{2, "switch.bin", "File already exists"},
+		{1, "broken.bin", "Transfer failed"},
+	}
+	for _, tt := range tests {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.NoError(t, err)
+		tftpRequestForTest(t, conn, server, tt.op, tt.name)
+		p, from := tftpReceiveForTest(t, conn)
+		assert.Equal(t, tftpErrorPacketForTest(1, tt.msg), p, tt.name)
+		assert.True(t, from.IP.Equal(server.IP), tt.name)
+		// the transfer answers once, no second error from another port
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = conn.ReadFromUDP(make([]byte, 516))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded, tt.name)
+		conn.Close()
+	}
+
+	// an error in the middle of a download comes from the transfer's port
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer conn.Close()
+	tftpRequestForTest(t, conn, server, 1, "flaky.bin")
+	p, tid := tftpReceiveForTest(t, conn)
+	assert.Equal(t, uint16(3), binary.BigEndian.Uint16(p), "first data block")
+	assert.NotEqual(t, server.Port, tid.Port)
+	_, err = conn.WriteToUDP([]byte{0, 4, 0, 1}, tid)
+	assert.NoError(t, err)
+	p, from := tftpReceiveForTest(t, conn)
+	assert.Equal(t, tftpErrorPacketForTest(1, "Transfer failed"), p)
+	assert.Equal(t, tid.String(), from.String())
+}
+
+func tftpRequestForTest(t *testing.T, conn *net.UDPConn, server *net.UDPAddr, op uint16, name string) {
+	p := binary.BigEndian.AppendUint16(nil, op)
+	p = append(append(p, name...), 0)
+	p = append(append(p, "octet"...), 0)
+	_, err := conn.WriteToUDP(p, server)
+	assert.NoError(t, err)
+}
+
+func tftpReceiveForTest(t *testing.T, conn *net.UDPConn) ([]byte, *net.UDPAddr) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 516)
+	n, from, err := conn.ReadFromUDP(buf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return buf[:n], from
+}
+
+func tftpErrorPacketForTest(code uint16, msg string) []byte {
+	p := binary.BigEndian.AppendUint16(nil, 5)
+	p = binary.BigEndian.AppendUint16(p, code)
+	return append(append(p, msg...), 0)
+}
+
+// brokenFs fails the way remote backends do, with details not meant for clients
+type brokenFs struct {
+	afero.Fs
+}
+
+func (m *brokenFs) Open(name string) (afero.File, error) {
+	switch name {
+	case "forbidden.bin":
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	case "broken.bin":
+		return nil, fmt.Errorf("GET https://secret@storage.example.com/%s: 500 Internal Server Error", name)
+	}
+	file, err := m.Fs.Open(name)
+	if err != nil || name != "flaky.bin" {
+		return file, err
+	}
+	return &brokenFile{File: file}, nil
+}
+
+// brokenFile fails after the first block
+type brokenFile struct {
+	afero.File
+	read int
+}
+
+func (m *brokenFile) Read(p []byte) (int, error) {
+	if m.read >= 512 {
+		return 0, errors.New("connection reset by storage.example.com")
+	}
+	n, err := m.File.Read(p[:min(len(p), 512-m.read)])
+	m.read += n
+	return n, err
+}
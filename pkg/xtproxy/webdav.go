@@ -0,0 +1,173 @@
+package xtproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/azryve/xtproxy/pkg/aferowebdav"
+	"github.com/spf13/afero"
+	"golang.org/x/net/webdav"
+)
+
+// webdavURL webdav[s]://[user:password@]host[:port]/path
+// webdavs is webdav over https
+type webdavURL struct {
+	URL *url.URL
+}
+
+type webdavParams struct {
+	Root string // http url of the collection
+	User string
+	Pass string
+}
+
+func (m webdavURL) Fs() (afero.Fs, error) {
+	if m.URL.Scheme != "webdav" && m.URL.Scheme != "webdavs" {
+		return nil, ErrInvalidURL
+	}
+	params, err := fsSchemeWebdavParams(m.URL)
+	if err != nil {
+		return nil, err
+	}
+	return aferowebdav.NewWebdavFs(params.Root, params.User, params.Pass), nil
+}
+
+func fsSchemeWebdavParams(u *url.URL) (webdavParams, error) {
+	if u.Host == "" {
+		return webdavParams{}, fmt.Errorf("url: %s: expected host: %w", u.Redacted(), ErrInvalidURL)
+	}
+	for key, values := range u.Query() {
+		return webdavParams{}, fmt.Errorf("url: %s=%s: unknown parameter: %w", key, values[len(values)-1], ErrInvalidURL)
+	}
+	root := url.URL{Scheme: "http", Host: u.Host, Path: u.Path}
+	if u.Scheme == "webdavs" {
+		root.Scheme = "https"
+	}
+	params := webdavParams{Root: root.String(), User: u.User.Username()}
+	params.Pass, _ = u.User.Password()
+	return params, nil
+}
+
+// WebdavMiddleware serves webdav methods on fs passing GET, HEAD, POST and PUT to next,
+// changes denied by fs such as of read-only mounts are answered with 403
+func WebdavMiddleware(fs afero.Fs, next http.Handler) http.Handler {
+	dav := &webdav.Handler{
+		FileSystem: webdavFs{fs},
+		LockSystem: webdav.NewMemLS(),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut:
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &webdavResponseWriter{ResponseWriter: w}
+		dav.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), webdavResponseKey{}, rw)))
+	})
+}
+
+type webdavResponseKey struct{}
+
+// webdavResponseWriter replaces errors of webdav handler with 403 once fs denied a change
+// as the handler replies 405 or 404 to any error
+type webdavResponseWriter struct {
+	http.ResponseWriter
+	denied   bool
+	replaced bool
+}
+
+func (m *webdavResponseWriter) WriteHeader(code int) {
+	if m.denied && code >= http.StatusBadRequest {
+		m.replaced = true
+		httpError(m.ResponseWriter, fs.ErrPermission)
+		return
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *webdavResponseWriter) Write(p []byte) (int, error) {
+	if m.replaced {
+		return len(p), nil
+	}
+	return m.ResponseWriter.Write(p)
+}
+
+// webdavFs serves afero.Fs to webdav handler
+type webdavFs struct {
+	fs afero.Fs
+}
+
+// deny marks the response of request of ctx denied on permission errors
+func deny(ctx context.Context, err error) error {
+	if rw, ok := ctx.Value(webdavResponseKey{}).(*webdavResponseWriter); ok && errors.Is(err, fs.ErrPermission) {
+		rw.denied = true
+	}
+	return err
+}
+
+func (m webdavFs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return deny(ctx, m.fs.Mkdir(name, perm))
+}
+
+// OpenFile opens files the handler replaces as write-only
+// as not every backend can read files being written
+func (m webdavFs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_RDWR|os.O_TRUNC) == os.O_RDWR|os.O_TRUNC {
+		flag = flag&^os.O_RDWR | os.O_WRONLY
+	}
+	f, err := m.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, deny(ctx, err)
+	}
+	return webdavFile{f}, nil
+}
+
+func (m webdavFs) RemoveAll(ctx context.Context, name string) error {
+	return deny(ctx, m.fs.RemoveAll(name))
+}
+
+func (m webdavFs) Rename(ctx context.Context, oldName, newName string) error {
+	return deny(ctx, m.fs.Rename(oldName, newName))
+}
+
+func (m webdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := m.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+// webdavFile reports content types of files by name
+type webdavFile struct {
+	afero.File
+}
+
+func (m webdavFile) Stat() (os.FileInfo, error) {
+	info, err := m.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+// webdavFileInfo has content type by extension as ContentTypeMiddleware sets it
+// preventing webdav handler from reading files to sniff it
+type webdavFileInfo struct {
+	os.FileInfo
+}
+
+func (m webdavFileInfo) ContentType(ctx context.Context) (string, error) {
+	mimeType := mime.TypeByExtension(path.Ext(m.Name()))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType, nil
+}
@@ -1,71 +1,281 @@
 package xtproxy
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 
 	"github.com/spf13/afero"
-	"golang.org/x/sync/errgroup"
 )
 
 type waiter interface {
 	Wait() error
+	Run(ctx context.Context) error      // Wait until ctx is done
+	Shutdown(ctx context.Context) error // stop and drain active sessions until ctx is done
+	listen() error                      // binds the address before Wait
+	stop() error                        // stops accepting new sessions, active ones continue
+}
+
+// protocol names used to select mounts visible to a frontend
+const (
+	ProtocolFTP  = "ftp"
+	ProtocolTFTP = "tftp"
+	ProtocolHTTP = "http"
+)
+
+// protocolFs is an fs with different views per protocol like aferomount.MountFs
+type protocolFs interface {
+	ForProtocol(protocol string) afero.Fs
+}
+
+// fsForProtocol returns the view of fs for protocol if fs supports it
+func fsForProtocol(fs afero.Fs, protocol string) afero.Fs {
+	if pfs, ok := fs.(protocolFs); ok {
+		return pfs.ForProtocol(protocol)
+	}
+	return fs
 }
 
 type XTProxy struct {
-	Fs      afero.Fs
-	waiters []waiter
+	Fs           afero.Fs
+	ftpSettings  FTPSettings
+	tftpSettings TFTPSettings
+	httpSettings HTTPSettings
+	listeners    []listenerSpec // frontends to start once settings are known
+	mu           sync.Mutex     // guards waiters and run
+	waiters      map[string]waiter
+	run          *runGroup // set while Run is serving
+}
+
+// runGroup tracks frontends of Run, reload may add them at any time
+type runGroup struct {
+	ctx    context.Context // cancelled once any frontend fails
+	active int
+	errc   chan error
 }
 type XTProxyOpt func(m *XTProxy) error
 
+// listenerSpec describes a frontend to be created after all options applied
+type listenerSpec struct {
+	protocol string
+	addr     net.Addr
+	new      func() waiter
+}
+
 func NewXTProxy(fs afero.Fs, opts ...XTProxyOpt) (*XTProxy, error) {
 	fproxy := &XTProxy{
 		Fs:      fs,
-		waiters: make([]waiter, 0),
+		waiters: make(map[string]waiter),
 	}
-	for _, opt := range opts {
-		if err := opt(fproxy); err != nil {
-			return nil, err
-		}
+	if err := fproxy.Reload(opts...); err != nil {
+		fproxy.stop()
+		return nil, err
 	}
 	return fproxy, nil
 }
 
 func (m *XTProxy) Wait() error {
+	return m.Run(context.Background())
+}
+
+// Run serves all the frontends until ctx is done or any of them fails,
+// then the rest are shut down cancelling their active sessions
+func (m *XTProxy) Run(ctx context.Context) error {
+	m.mu.Lock()
 	if len(m.waiters) == 0 {
+		m.mu.Unlock()
 		return errors.New("nothing to wait")
 	}
-	g := errgroup.Group{}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	run := &runGroup{ctx: ctx, errc: make(chan error)}
+	m.run = run
 	for _, w := range m.waiters {
-		g.Go(w.Wait)
+		m.goRun(w)
+	}
+	m.mu.Unlock()
+	var first error
+	for {
+		err := <-run.errc
+		if err != nil && first == nil {
+			first = err
+			cancel()
+		}
+		m.mu.Lock()
+		run.active--
+		if run.active == 0 {
+			m.run = nil
+			m.mu.Unlock()
+			return first
+		}
+		m.mu.Unlock()
+	}
+}
+
+// goRun runs w until the run is over, called with mu held
+func (m *XTProxy) goRun(w waiter) {
+	run := m.run
+	run.active++
+	go func() {
+		run.errc <- w.Run(run.ctx)
+	}()
+}
+
+// Shutdown stops accepting new sessions on all the frontends
+// and waits for active ones to finish, cancelling them once ctx is done
+func (m *XTProxy) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	waiters := make([]waiter, 0, len(m.waiters))
+	for key, w := range m.waiters {
+		waiters = append(waiters, w)
+		delete(m.waiters, key)
+	}
+	m.mu.Unlock()
+	errs := make([]error, len(waiters))
+	wg := sync.WaitGroup{}
+	for i, w := range waiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Reload applies listener options replacing the current ones
+// only frontends with changed address or settings are restarted,
+// sessions of the stopped frontends are allowed to finish
+func (m *XTProxy) Reload(opts ...XTProxyOpt) error {
+	next := &XTProxy{Fs: m.Fs}
+	for _, opt := range opts {
+		if err := opt(next); err != nil {
+			return err
+		}
 	}
-	return g.Wait()
+	specs := make(map[string]listenerSpec)
+	for _, spec := range next.listeners {
+		specs[next.listenerKey(spec)] = spec
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ftpSettings = next.ftpSettings
+	m.tftpSettings = next.tftpSettings
+	m.httpSettings = next.httpSettings
+	m.listeners = next.listeners
+	var errs []error
+	for key, w := range m.waiters {
+		if _, ok := specs[key]; !ok {
+			errs = append(errs, w.stop())
+			go w.Shutdown(context.Background())
+			delete(m.waiters, key)
+		}
+	}
+	for key, spec := range specs {
+		if _, ok := m.waiters[key]; ok {
+			continue
+		}
+		w := spec.new()
+		if err := w.listen(); err != nil {
+			errs = append(errs, fmt.Errorf("%s://%s: %w", spec.protocol, spec.addr, err))
+			continue
+		}
+		m.waiters[key] = w
+		if m.run != nil {
+			m.goRun(w)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stop stops all the frontends
+func (m *XTProxy) stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for key, w := range m.waiters {
+		errs = append(errs, w.stop())
+		delete(m.waiters, key)
+	}
+	return errors.Join(errs...)
+}
+
+// listenerKey identifies a frontend by protocol, address and its settings
+func (m *XTProxy) listenerKey(spec listenerSpec) string {
+	var settings any
+	switch spec.protocol {
+	case ProtocolFTP:
+		settings = m.ftpSettings
+	case ProtocolTFTP:
+		settings = m.tftpSettings
+	case ProtocolHTTP:
+		settings = m.httpSettings
+	}
+	return fmt.Sprintf("%s://%s %+v", spec.protocol, spec.addr, settings)
 }
 
 func WithFTPAddr(addr *net.TCPAddr) XTProxyOpt {
 	return func(m *XTProxy) error {
-		ftp := &XTProxyFTP{Fs: m.Fs, ListenAddr: addr}
-		m.waiters = append(m.waiters, ftp)
+		m.listeners = append(m.listeners, listenerSpec{ProtocolFTP, addr, func() waiter {
+			return &XTProxyFTP{
+				Fs:         fsForProtocol(m.Fs, ProtocolFTP),
+				ListenAddr: addr,
+				Settings:   m.ftpSettings,
+			}
+		}})
 		return nil
 	}
 }
 
 func WithTFTPAddr(addr *net.UDPAddr) XTProxyOpt {
 	return func(m *XTProxy) error {
-		tftp := &XTProxyTFTP{Fs: m.Fs, ListenAddr: addr}
-		m.waiters = append(m.waiters, tftp)
+		m.listeners = append(m.listeners, listenerSpec{ProtocolTFTP, addr, func() waiter {
+			return &XTProxyTFTP{
+				Fs:         fsForProtocol(m.Fs, ProtocolTFTP),
+				ListenAddr: addr,
+				Settings:   m.tftpSettings,
+			}
+		}})
 		return nil
 	}
 }
 
 func WithHTTPAddr(addr *net.TCPAddr) XTProxyOpt {
 	return func(m *XTProxy) error {
-		listener, err := net.ListenTCP("tcp", addr)
-		if err != nil {
-			return err
-		}
-		http := &XTProxyHTTP{Fs: m.Fs, Listener: listener}
-		m.waiters = append(m.waiters, http)
+		m.listeners = append(m.listeners, listenerSpec{ProtocolHTTP, addr, func() waiter {
+			return &XTProxyHTTP{
+				Fs:         fsForProtocol(m.Fs, ProtocolHTTP),
+				ListenAddr: addr,
+				Settings:   m.httpSettings,
+			}
+		}})
+		return nil
+	}
+}
+
+// WithFTPSettings tunes all ftp frontends regardless of option order
+func WithFTPSettings(settings FTPSettings) XTProxyOpt {
+	return func(m *XTProxy) error {
+		m.ftpSettings = settings
+		return nil
+	}
+}
+
+// WithTFTPSettings tunes all tftp frontends regardless of option order
+func WithTFTPSettings(settings TFTPSettings) XTProxyOpt {
+	return func(m *XTProxy) error {
+		m.tftpSettings = settings
+		return nil
+	}
+}
+
+// WithHTTPSettings tunes all http frontends regardless of option order
+func WithHTTPSettings(settings HTTPSettings) XTProxyOpt {
+	return func(m *XTProxy) error {
+		m.httpSettings = settings
 		return nil
 	}
 }
@@ -1,13 +1,22 @@
 package xtproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/textproto"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/azryve/xtproxy/pkg/aferodecompress"
+	"github.com/jlaffaye/ftp"
+	"github.com/pin/tftp/v3"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 )
@@ -50,6 +59,13 @@ func TestHTTPToHTTP(t *testing.T) {
 	xhttp := xtproxyHttpProxyForTest(t, fs)
 	go xhttp.Wait()
 
+	// listing of xtproxy itself
+	infos, err := afero.ReadDir(fs, "/a")
+	assert.NoError(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "file.txt", infos[0].Name())
+	}
+
 	// ok file
 	url := fmt.Sprintf("http://%s/a/file.txt", xhttp.Listener.Addr().String())
 	httpc := &http.Client{}
@@ -59,11 +75,157 @@ func TestHTTPToHTTP(t *testing.T) {
 	io.Copy(&buf, r.Body)
 	assert.Equal(t, "file contents", buf.String())
 
-	// missing file - will return 500 for now
+	// missing file
 	url = fmt.Sprintf("http://%s/missing.txt", xhttp.Listener.Addr().String())
 	r, err = httpc.Get(url)
 	assert.NoError(t, err)
-	assert.Equal(t, 500, r.StatusCode)
+	assert.Equal(t, 404, r.StatusCode)
+}
+
+func TestHTTPBackendErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/forbidden.txt":
+			w.WriteHeader(http.StatusForbidden)
+		case "/gone.txt":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+	fs, err := FsByURL(upstream.URL)
+	assert.NoError(t, err)
+
+	t.Run("http", func(t *testing.T) {
+		xhttp := xtproxyHttpProxyForTest(t, fs)
+		go xhttp.Wait()
+		defer xhttp.Shutdown(context.Background())
+		for name, code := range map[string]int{"missing.txt": 404, "gone.txt": 404, "forbidden.txt": 403} {
+			r, err := http.Get(fmt.Sprintf("http://%s/%s", xhttp.Listener.Addr().String(), name))
+			assert.NoError(t, err)
+			r.Body.Close()
+			assert.Equal(t, code, r.StatusCode, name)
+		}
+	})
+
+	t.Run("ftp", func(t *testing.T) {
+		xftp := &XTProxyFTP{Fs: fs, ListenAddr: freeTCPAddrForTest(t)}
+		assert.NoError(t, xftp.listen())
+		go xftp.Wait()
+		defer xftp.Shutdown(context.Background())
+		c, err := ftp.Dial(xftp.ListenAddr.String(), ftp.DialWithTimeout(5*time.Second))
+		assert.NoError(t, err)
+		defer c.Quit()
+		assert.NoError(t, c.Login("anonymous", "anonymous"))
+		for _, name := range []string{"missing.txt", "gone.txt", "forbidden.txt"} {
+			_, err := c.Retr(name)
+			var perr *textproto.Error
+			if assert.ErrorAs(t, err, &perr, name) {
+				assert.Equal(t, ftp.StatusFileUnavailable, perr.Code, name)
+			}
+		}
+	})
+
+	t.Run("tftp", func(t *testing.T) {
+		xtftp := &XTProxyTFTP{Fs: fs, ListenAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+		assert.NoError(t, xtftp.listen())
+		go xtftp.Wait()
+		defer xtftp.Shutdown(context.Background())
+		c, err := tftp.NewClient(xtftp.conn.LocalAddr().String())
+		assert.NoError(t, err)
+		c.SetTimeout(time.Second)
+		// pin/tftp sends code 1 for every error, the message tells them apart
+		for name, msg := range map[string]string{"missing.txt": "File not found", "gone.txt": "File not found", "forbidden.txt": "Access violation"} {
+			_, err := c.Receive(name, "octet")
+			assert.ErrorContains(t, err, fmt.Sprintf("code: 1, message: %s", msg), name)
+		}
+	})
+}
+
+func TestHTTPToHTTPRange(t *testing.T) {
+	basefs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(basefs, "/file.txt", []byte("file contents"), 0644))
+	xhttpbase := xtproxyHttpProxyForTest(t, basefs)
+	go xhttpbase.Wait()
+
+	fs, err := FsByURL(fmt.Sprintf("http://%s", xhttpbase.Listener.Addr().String()))
+	assert.NoError(t, err)
+	xhttp := xtproxyHttpProxyForTest(t, fs)
+	go xhttp.Wait()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/file.txt", xhttp.Listener.Addr().String()), nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=5-")
+	r, err := (&http.Client{}).Do(req)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "contents", string(body))
+}
+
+func TestReload(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/file.txt", []byte("file contents"), 0644))
+	addr1 := freeTCPAddrForTest(t)
+	addr2 := freeTCPAddrForTest(t)
+
+	fproxy, err := NewXTProxy(fs, WithHTTPAddr(addr1))
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- fproxy.Wait() }()
+
+	httpc := &http.Client{}
+	get := func(addr *net.TCPAddr) (*http.Response, error) {
+		return httpc.Get(fmt.Sprintf("http://%s/file.txt", addr))
+	}
+	r, err := get(addr1)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+	r.Body.Close()
+
+	// unchanged listener keeps running, new one is added
+	assert.NoError(t, fproxy.Reload(WithHTTPAddr(addr1), WithHTTPAddr(addr2)))
+	for _, addr := range []*net.TCPAddr{addr1, addr2} {
+		r, err := get(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, r.StatusCode)
+		r.Body.Close()
+	}
+
+	// removed listener stops accepting
+	httpc.CloseIdleConnections()
+	assert.NoError(t, fproxy.Reload(WithHTTPAddr(addr2)))
+	_, err = get(addr1)
+	assert.Error(t, err)
+	r, err = get(addr2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+	r.Body.Close()
+
+	// changed settings restart listener on the same address
+	httpc.CloseIdleConnections()
+	assert.NoError(t, fproxy.Reload(
+		WithHTTPSettings(HTTPSettings{IdleTimeout: time.Second}),
+		WithHTTPAddr(addr2),
+	))
+	r, err = get(addr2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+	r.Body.Close()
+
+	httpc.CloseIdleConnections()
+	assert.NoError(t, fproxy.Reload())
+	assert.NoError(t, <-done)
+}
+
+func freeTCPAddrForTest(t *testing.T) *net.TCPAddr {
+	lsn, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer lsn.Close()
+	return lsn.Addr().(*net.TCPAddr)
 }
 
 func xtproxyHttpProxyForTest(t *testing.T, fs afero.Fs) *XTProxyHTTP {
@@ -74,3 +236,137 @@ func xtproxyHttpProxyForTest(t *testing.T, fs afero.Fs) *XTProxyHTTP {
 
 	return &XTProxyHTTP{Fs: fs, Listener: lsn}
 }
+
+func TestShutdown(t *testing.T) {
+	start := func(t *testing.T) (*XTProxy, *blockingFs, *net.TCPAddr, chan error) {
+		fs := &blockingFs{
+			Fs:      afero.NewMemMapFs(),
+			opened:  make(chan struct{}, 1),
+			release: make(chan struct{}),
+		}
+		assert.NoError(t, afero.WriteFile(fs.Fs, "/file.txt", []byte("file contents"), 0644))
+		addr := freeTCPAddrForTest(t)
+		fproxy, err := NewXTProxy(fs, WithHTTPAddr(addr))
+		assert.NoError(t, err)
+		done := make(chan error)
+		go func() { done <- fproxy.Run(context.Background()) }()
+		return fproxy, fs, addr, done
+	}
+	get := func(addr *net.TCPAddr) (string, error) {
+		r, err := (&http.Client{}).Get(fmt.Sprintf("http://%s/file.txt", addr))
+		if err != nil {
+			return "", err
+		}
+		defer r.Body.Close()
+		body, err := io.ReadAll(r.Body)
+		return string(body), err
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		fproxy, fs, addr, done := start(t)
+		body := make(chan string)
+		go func() {
+			b, _ := get(addr)
+			body <- b
+		}()
+		<-fs.opened
+		shutdown := make(chan error)
+		go func() { shutdown <- fproxy.Shutdown(context.Background()) }()
+		assert.NoError(t, <-done)
+		_, err := get(addr)
+		assert.Error(t, err)
+		close(fs.release)
+		assert.Equal(t, "file contents", <-body)
+		assert.NoError(t, <-shutdown)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		fproxy, fs, addr, done := start(t)
+		defer close(fs.release)
+		failed := make(chan error)
+		go func() {
+			_, err := get(addr)
+			failed <- err
+		}()
+		<-fs.opened
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, fproxy.Shutdown(ctx), context.DeadlineExceeded)
+		assert.Error(t, <-failed)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("run context", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		fproxy, err := NewXTProxy(fs, WithHTTPAddr(freeTCPAddrForTest(t)))
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- fproxy.Run(ctx) }()
+		cancel()
+		assert.NoError(t, <-done)
+	})
+}
+
+// blockingFs blocks reads until released
+type blockingFs struct {
+	afero.Fs
+	opened  chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingFs) Open(name string) (afero.File, error) {
+	file, err := m.Fs.Open(name)
+	if err != nil || name != "/file.txt" {
+		return file, err
+	}
+	m.opened <- struct{}{}
+	return &blockingFile{File: file, release: m.release}, nil
+}
+
+type blockingFile struct {
+	afero.File
+	release chan struct{}
+}
+
+func (m *blockingFile) Read(p []byte) (int, error) {
+	<-m.release
+	return m.File.Read(p)
+}
+
+func TestDecompressSize(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write([]byte(strings.Repeat("switch image ", 1000)))
+	assert.NoError(t, err)
+	assert.NoError(t, gw.Close())
+	basefs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(basefs, "/switch.bin.gz", gz.Bytes(), 0644))
+	fs := aferodecompress.NewDecompressFs(basefs)
+
+	xhttp := xtproxyHttpProxyForTest(t, fs)
+	go xhttp.Wait()
+	r, err := http.Get(fmt.Sprintf("http://%s/switch.bin", xhttp.Listener.Addr().String()))
+	assert.NoError(t, err)
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(13000), r.ContentLength)
+	assert.Equal(t, strings.Repeat("switch image ", 1000), string(body))
+
+	xtftp := &XTProxyTFTP{Fs: fs, ListenAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	assert.NoError(t, xtftp.listen())
+	go xtftp.Wait()
+	defer xtftp.Shutdown(context.Background())
+	c, err := tftp.NewClient(xtftp.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	c.RequestTSize(true)
+	wt, err := c.Receive("/switch.bin", "octet")
+	assert.NoError(t, err)
+	tsize, ok := wt.(tftp.IncomingTransfer).Size()
+	assert.True(t, ok)
+	assert.Equal(t, int64(13000), tsize)
+	n, err := wt.WriteTo(io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(13000), n)
+}